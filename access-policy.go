@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const accessPolicyPollInterval = 10 * time.Second
+
+// accessList matches users by exact email, email domain, or user key
+type accessList struct {
+	Emails  []string
+	Domains []string
+	// Subs are matched against the provider-qualified user key, which for Google is the bare subject
+	Subs []string
+}
+
+type accessPolicyConfig struct {
+	Allow accessList
+	Deny  accessList
+}
+
+// AccessPolicy decides who may sign in, reloading its file whenever it changes
+type AccessPolicy struct {
+	path    string
+	lock    sync.RWMutex
+	config  accessPolicyConfig
+	modTime time.Time
+}
+
+func (l *accessList) empty() bool {
+	return len(l.Emails) == 0 && len(l.Domains) == 0 && len(l.Subs) == 0
+}
+
+func (l *accessList) matches(email string, userKey string) bool {
+	email = strings.ToLower(email)
+
+	for _, listEmail := range l.Emails {
+		if strings.ToLower(listEmail) == email {
+			return true
+		}
+	}
+
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		domain := email[at+1:]
+
+		for _, listDomain := range l.Domains {
+			if strings.ToLower(strings.TrimPrefix(listDomain, "@")) == domain {
+				return true
+			}
+		}
+	}
+
+	return containsString(l.Subs, userKey)
+}
+
+// LoadAccessPolicy loads the policy at path and watches it for changes until ctx is done
+func LoadAccessPolicy(ctx context.Context, path string) (*AccessPolicy, error) {
+	p := &AccessPolicy{
+		path: path,
+	}
+
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(accessPolicyPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reloaded, err := p.reload()
+
+				if err != nil {
+					log.Println("Error reloading access policy, keeping previous policy:", err)
+				} else if reloaded {
+					log.Println("Reloaded access policy")
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func (p *AccessPolicy) reload() (reloaded bool, err error) {
+	info, err := os.Stat(p.path)
+
+	if err != nil {
+		return
+	}
+
+	p.lock.RLock()
+	unchanged := info.ModTime().Equal(p.modTime)
+	p.lock.RUnlock()
+
+	if unchanged {
+		return
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+
+	if err != nil {
+		return
+	}
+
+	var config accessPolicyConfig
+
+	if err = json.Unmarshal(data, &config); err != nil {
+		err = fmt.Errorf("parsing %s: %v", p.path, err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.config = config
+	p.modTime = info.ModTime()
+
+	reloaded = true
+	return
+}
+
+// Check returns an error explaining why the user may not sign in, or nil if they may.
+// A nil policy allows everyone.
+func (p *AccessPolicy) Check(email string, userKey string) error {
+	if p == nil {
+		return nil
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	// Local users have no verified email, so are named by their user key
+	account := email
+
+	if account == "" {
+		account = userKey
+	}
+
+	if p.config.Deny.matches(email, userKey) {
+		return fmt.Errorf("The account %s has been denied access to this service", account)
+	}
+
+	if !p.config.Allow.empty() && !p.config.Allow.matches(email, userKey) {
+		return fmt.Errorf("The account %s is not allowed to sign in to this service", account)
+	}
+
+	return nil
+}
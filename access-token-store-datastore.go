@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreAccessTokenStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreAccessTokenStore(c *datastore.Client) *datastoreAccessTokenStore {
+	return &datastoreAccessTokenStore{
+		c: c,
+	}
+}
+
+func accessTokenKey(token string) *datastore.Key {
+	return datastore.NameKey(accessTokenKind, hashToken(token), nil)
+}
+
+func (s *datastoreAccessTokenStore) Lookup(ctx context.Context, token string) (*accessToken, error) {
+	var storedToken accessToken
+
+	if err := s.c.Get(ctx, accessTokenKey(token), &storedToken); err == datastore.ErrNoSuchEntity {
+		return nil, errorTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	storedToken.Token = token
+
+	return &storedToken, nil
+}
+
+func (s *datastoreAccessTokenStore) Create(ctx context.Context, token *accessToken) error {
+	_, err := s.c.Put(ctx, accessTokenKey(token.Token), token)
+
+	return err
+}
+
+func (s *datastoreAccessTokenStore) Touch(ctx context.Context, token string, lastUsed time.Time) error {
+	key := accessTokenKey(token)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var storedToken accessToken
+
+		if err := tx.Get(key, &storedToken); err == datastore.ErrNoSuchEntity {
+			return errorTokenNotFound
+		} else if err != nil {
+			return err
+		}
+
+		storedToken.LastUsed = lastUsed
+
+		_, err := tx.Put(key, &storedToken)
+
+		return err
+	})
+
+	return err
+}
+
+func (s *datastoreAccessTokenStore) List(ctx context.Context, user string) ([]*accessToken, error) {
+	var tokens []*accessToken
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(accessTokenKind).Filter("User =", user), &tokens); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (s *datastoreAccessTokenStore) RevokeByID(ctx context.Context, user string, id string) error {
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(accessTokenKind).Filter("User =", user).Filter("ID =", id).KeysOnly(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return errorTokenNotFound
+	}
+
+	return s.c.DeleteMulti(ctx, keys)
+}
+
+func (s *datastoreAccessTokenStore) Reassign(ctx context.Context, from string, to string) error {
+	var tokens []*accessToken
+
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(accessTokenKind).Filter("User =", from), &tokens)
+
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		token.User = to
+	}
+
+	return datastoreBatches(len(keys), func(start int, end int) error {
+		_, err := s.c.PutMulti(ctx, keys[start:end], tokens[start:end])
+
+		return err
+	})
+}
+
+func (s *datastoreAccessTokenStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	// Tokens which never expire have the zero time as their expiry
+	return datastoreDeleteMatching(ctx, s.c, datastore.NewQuery(accessTokenKind).Filter("Expiry >", time.Time{}).Filter("Expiry <", now))
+}
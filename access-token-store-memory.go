@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryAccessTokenStore keeps access tokens for the lifetime of the process, keyed by token hash
+type memoryAccessTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]accessToken
+}
+
+func newMemoryAccessTokenStore() *memoryAccessTokenStore {
+	return &memoryAccessTokenStore{
+		tokens: make(map[string]accessToken),
+	}
+}
+
+func (s *memoryAccessTokenStore) Lookup(ctx context.Context, token string) (*accessToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storedToken, found := s.tokens[hashToken(token)]
+
+	if !found {
+		return nil, errorTokenNotFound
+	}
+
+	storedToken.Token = token
+
+	return &storedToken, nil
+}
+
+func (s *memoryAccessTokenStore) Create(ctx context.Context, token *accessToken) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storedToken := *token
+	storedToken.Token = ""
+
+	s.tokens[hashToken(token.Token)] = storedToken
+
+	return nil
+}
+
+func (s *memoryAccessTokenStore) Touch(ctx context.Context, token string, lastUsed time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokenHash := hashToken(token)
+
+	storedToken, found := s.tokens[tokenHash]
+
+	if !found {
+		return errorTokenNotFound
+	}
+
+	storedToken.LastUsed = lastUsed
+	s.tokens[tokenHash] = storedToken
+
+	return nil
+}
+
+func (s *memoryAccessTokenStore) List(ctx context.Context, user string) ([]*accessToken, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokens := []*accessToken{}
+
+	for _, token := range s.tokens {
+		if token.User == user {
+			token := token
+			tokens = append(tokens, &token)
+		}
+	}
+
+	return tokens, nil
+}
+
+func (s *memoryAccessTokenStore) RevokeByID(ctx context.Context, user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for tokenHash, token := range s.tokens {
+		if token.User == user && token.ID == id {
+			delete(s.tokens, tokenHash)
+			return nil
+		}
+	}
+
+	return errorTokenNotFound
+}
+
+func (s *memoryAccessTokenStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for tokenHash, token := range s.tokens {
+		if token.User == from {
+			token.User = to
+			s.tokens[tokenHash] = token
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryAccessTokenStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for tokenHash, token := range s.tokens {
+		if !token.Expiry.IsZero() && token.Expiry.Before(now) {
+			delete(s.tokens, tokenHash)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type sqliteAccessTokenStore struct {
+	db *sql.DB
+}
+
+func newSQLiteAccessTokenStore(db *sql.DB) *sqliteAccessTokenStore {
+	return &sqliteAccessTokenStore{
+		db: db,
+	}
+}
+
+const sqliteAccessTokenColumns = "user, user_key, email, id, name, scopes, created, expiry, last_used"
+
+func scanSQLiteAccessToken(row sqliteScanner) (*accessToken, error) {
+	var token accessToken
+
+	var scopes string
+
+	var created, expiry, lastUsed int64
+
+	if err := row.Scan(&token.User, &token.UserKey, &token.Email, &token.ID, &token.Name, &scopes, &created, &expiry, &lastUsed); err != nil {
+		return nil, err
+	}
+
+	// Scopes are stored space separated, as in OAuth
+	token.Scopes = strings.Fields(scopes)
+	token.Created = fromSQLiteTime(created)
+	token.Expiry = fromSQLiteTime(expiry)
+	token.LastUsed = fromSQLiteTime(lastUsed)
+
+	return &token, nil
+}
+
+func (s *sqliteAccessTokenStore) Lookup(ctx context.Context, token string) (*accessToken, error) {
+	storedToken, err := scanSQLiteAccessToken(s.db.QueryRowContext(ctx, "SELECT "+sqliteAccessTokenColumns+" FROM access_tokens WHERE token_hash = ?", hashToken(token)))
+
+	if err == sql.ErrNoRows {
+		return nil, errorTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	storedToken.Token = token
+
+	return storedToken, nil
+}
+
+func (s *sqliteAccessTokenStore) Create(ctx context.Context, token *accessToken) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO access_tokens (token_hash, "+sqliteAccessTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hashToken(token.Token), token.User, token.UserKey, token.Email, token.ID, token.Name, strings.Join(token.Scopes, " "), sqliteTime(token.Created), sqliteTime(token.Expiry), sqliteTime(token.LastUsed))
+
+	return err
+}
+
+func (s *sqliteAccessTokenStore) Touch(ctx context.Context, token string, lastUsed time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE access_tokens SET last_used = ? WHERE token_hash = ?", sqliteTime(lastUsed), hashToken(token))
+
+	if err != nil {
+		return err
+	}
+
+	return sqliteRequireUpdate(result)
+}
+
+func (s *sqliteAccessTokenStore) List(ctx context.Context, user string) ([]*accessToken, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteAccessTokenColumns+" FROM access_tokens WHERE user = ?", user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tokens := []*accessToken{}
+
+	for rows.Next() {
+		token, err := scanSQLiteAccessToken(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (s *sqliteAccessTokenStore) RevokeByID(ctx context.Context, user string, id string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE user = ? AND id = ?", user, id)
+
+	if err != nil {
+		return err
+	}
+
+	return sqliteRequireUpdate(result)
+}
+
+func (s *sqliteAccessTokenStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE access_tokens SET user = ? WHERE user = ?", to, from)
+
+	return err
+}
+
+func (s *sqliteAccessTokenStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	// Tokens which never expire have an expiry of 0
+	_, err := s.db.ExecContext(ctx, "DELETE FROM access_tokens WHERE expiry != 0 AND expiry < ?", sqliteTime(now))
+
+	return err
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// AccessTokenStore persists personal access tokens
+type AccessTokenStore interface {
+	// Lookup finds the access token, returning errorTokenNotFound if there is none
+	Lookup(ctx context.Context, token string) (*accessToken, error)
+	Create(ctx context.Context, token *accessToken) error
+	// Touch records when a token was last used, returning errorTokenNotFound if it has been revoked
+	Touch(ctx context.Context, token string, lastUsed time.Time) error
+	// List finds all of a user's access tokens
+	List(ctx context.Context, user string) ([]*accessToken, error)
+	// RevokeByID revokes one of a user's access tokens, returning errorTokenNotFound if they have no such token
+	RevokeByID(ctx context.Context, user string, id string) error
+	// Reassign moves every access token of a user to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+	// DeleteExpired removes every access token with an expiry before now
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
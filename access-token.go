@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const accessTokenKind = "AccessToken"
+
+const accessTokensPath = "/tokens"
+
+const accessTokenSize = 32
+
+// accessTokenPrefix makes access tokens recognisable, for instance by secret scanners
+const accessTokenPrefix = "pat_"
+
+const maxAccessTokenNameLength = 100
+
+// defaultAccessTokenLifetime is given to tokens requested without a lifetime, and maxAccessTokenLifetime bounds every token's
+const (
+	defaultAccessTokenLifetime = 90 * 24 * time.Hour
+	maxAccessTokenLifetime     = 365 * 24 * time.Hour
+)
+
+// accessTokenTouchInterval limits how often the last use of a token is recorded
+const accessTokenTouchInterval = time.Minute
+
+const bearerPrefix = "Bearer "
+
+// Scopes limit what an access token may be used for, sessions have every scope
+const (
+	scopeUpload = "upload"
+	scopeRead   = "read"
+	scopeDelete = "delete"
+)
+
+var accessTokenScopes = []string{scopeUpload, scopeRead, scopeDelete}
+
+var errorMissingScope = errors.New("Access token lacks scope")
+
+type accessToken struct {
+	User string
+	// UserKey identifies the user to the access policy, which is checked again whenever the token is used
+	UserKey string
+	Email   string
+	// Token is never stored, access tokens are keyed by its hash instead
+	Token    string `datastore:"-"`
+	ID       string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expiry   time.Time
+	LastUsed time.Time
+}
+
+// accessTokenInfo describes an access token to its user
+type accessTokenInfo struct {
+	ID       string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	Expiry   time.Time `json:",omitempty"`
+	LastUsed time.Time `json:",omitempty"`
+}
+
+type accessTokenRequest struct {
+	Name   string
+	Scopes []string
+	// ExpiresIn is the lifetime of the token in seconds, or 0 for the default lifetime
+	ExpiresIn int64
+}
+
+type createdAccessToken struct {
+	accessTokenInfo
+	Token string
+}
+
+// requestAuth is who made a request, with either a session or an access token
+type requestAuth struct {
+	User string
+	// Email is only set if an identity provider verified it
+	Email string
+	// ID identifies the session or access token, so that streams using it end when it is revoked
+	ID string
+	// Session is nil for requests made with access tokens
+	Session *sessionCookie
+}
+
+func sessionAuth(session *sessionCookie) *requestAuth {
+	return &requestAuth{
+		User:    session.User,
+		Email:   verifiedEmail(session.Email, session.UserKey),
+		ID:      session.ID,
+		Session: session,
+	}
+}
+
+func newAccessTokenInfo(token *accessToken) accessTokenInfo {
+	return accessTokenInfo{
+		ID:       token.ID,
+		Name:     token.Name,
+		Scopes:   token.Scopes,
+		Created:  token.Created,
+		Expiry:   token.Expiry,
+		LastUsed: token.LastUsed,
+	}
+}
+
+// bearerToken finds the token of a request's Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+
+	if len(authorization) < len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[len(bearerPrefix):]), true
+}
+
+func getAccessToken(ctx context.Context, accessPolicy *AccessPolicy, store AccessTokenStore, token string, scope string) (*accessToken, error) {
+	storedToken, err := store.Lookup(ctx, token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if !storedToken.Expiry.IsZero() && now.After(storedToken.Expiry) {
+		return nil, errorTokenErpired
+	}
+
+	// Users denied since creating the token lose access with it
+	if err := accessPolicy.Check(storedToken.Email, storedToken.UserKey); err != nil {
+		return nil, err
+	}
+
+	if !containsString(storedToken.Scopes, scope) {
+		return nil, errorMissingScope
+	}
+
+	if now.Sub(storedToken.LastUsed) > accessTokenTouchInterval {
+		if err := store.Touch(ctx, token, now); err != nil {
+			return nil, err
+		}
+
+		storedToken.LastUsed = now
+	}
+
+	return storedToken, nil
+}
+
+// authenticateRequest finds who made a request, from its bearer token if it has one and otherwise from its session cookie
+func authenticateRequest(ctx context.Context, accessPolicy *AccessPolicy, sessionStore SessionStore, accessTokenStore AccessTokenStore, r *http.Request, scope string) (*requestAuth, error) {
+	if token, found := bearerToken(r); found {
+		// Bearer tokens are never sent automatically by browsers, so need no CSRF protection
+		storedToken, err := getAccessToken(ctx, accessPolicy, accessTokenStore, token, scope)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &requestAuth{
+			User:  storedToken.User,
+			Email: verifiedEmail(storedToken.Email, storedToken.UserKey),
+			ID:    storedToken.ID,
+		}, nil
+	}
+
+	session, err := getRequestSession(ctx, accessPolicy, sessionStore, r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionAuth(session), nil
+}
+
+func genAccessToken(ctx context.Context, store AccessTokenStore, session *sessionCookie, request *accessTokenRequest) (*accessToken, error) {
+	token, err := randomToken(accessTokenSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomToken(sessionIDSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	lifetime := defaultAccessTokenLifetime
+
+	if request.ExpiresIn > 0 {
+		lifetime = time.Duration(request.ExpiresIn) * time.Second
+	}
+
+	newToken := &accessToken{
+		User:    session.User,
+		UserKey: session.UserKey,
+		Email:   session.Email,
+		Token:   accessTokenPrefix + token,
+		ID:      id,
+		Name:    request.Name,
+		Scopes:  request.Scopes,
+		Created: now,
+		Expiry:  now.Add(lifetime),
+	}
+
+	if err := store.Create(ctx, newToken); err != nil {
+		return nil, err
+	}
+
+	return newToken, nil
+}
+
+func validateAccessTokenRequest(request *accessTokenRequest) error {
+	if request.Name == "" || len(request.Name) > maxAccessTokenNameLength {
+		return fmt.Errorf("Access tokens need a name of at most %d bytes", maxAccessTokenNameLength)
+	}
+
+	if len(request.Scopes) == 0 {
+		return errors.New("Access tokens need at least one scope")
+	}
+
+	for _, scope := range request.Scopes {
+		if !containsString(accessTokenScopes, scope) {
+			return fmt.Errorf("Unknown scope %q", scope)
+		}
+	}
+
+	if request.ExpiresIn < 0 {
+		return errors.New("Access tokens cannot expire in the past")
+	}
+
+	if request.ExpiresIn > int64(maxAccessTokenLifetime/time.Second) {
+		return fmt.Errorf("Access tokens last at most %d days", maxAccessTokenLifetime/(24*time.Hour))
+	}
+
+	return nil
+}
+
+type accessTokensHandler struct {
+	accessPolicy     *AccessPolicy
+	sessionStore     SessionStore
+	accessTokenStore AccessTokenStore
+	notificationBus  NotificationBus
+}
+
+func (h *accessTokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Access tokens are only managed from sessions, so a leaked token cannot mint more
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, accessTokensPath), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		tokens, err := h.accessTokenStore.List(r.Context(), session.User)
+
+		if err != nil {
+			log.Println("Error listing access tokens:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+
+		infos := []accessTokenInfo{}
+
+		for _, token := range tokens {
+			if !token.Expiry.IsZero() && now.After(token.Expiry) {
+				continue
+			}
+
+			infos = append(infos, newAccessTokenInfo(token))
+		}
+
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Created.After(infos[j].Created)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(infos); err != nil {
+			log.Println("Error writing access tokens:", err)
+		}
+	case r.Method == "POST" && id == "":
+		var request accessTokenRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateAccessTokenRequest(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, err := genAccessToken(r.Context(), h.accessTokenStore, session, &request)
+
+		if err != nil {
+			log.Println("Error creating access token:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		log.Println("User", session.User, "created access token", token.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		// The token itself is only ever shown here
+		if err := json.NewEncoder(w).Encode(&createdAccessToken{
+			accessTokenInfo: newAccessTokenInfo(token),
+			Token:           token.Token,
+		}); err != nil {
+			log.Println("Error writing access token:", err)
+		}
+	case r.Method == "DELETE" && id != "":
+		if err := h.accessTokenStore.RevokeByID(r.Context(), session.User, id); err == errorTokenNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error revoking access token:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// Event streams opened with the token end just as those of revoked sessions do
+		if err := publishSessionRevoked(r.Context(), h.notificationBus, session.User, id); err != nil {
+			log.Println("Error publishing access token revocation:", err)
+		}
+
+		fmt.Fprintln(w, "Revoked")
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// AccessTokensHandler handles creating, listing and revoking personal access tokens, under its path and the path of each token
+func AccessTokensHandler(accessPolicy *AccessPolicy, sessionStore SessionStore, accessTokenStore AccessTokenStore, notificationBus NotificationBus) (string, http.Handler) {
+	return accessTokensPath, &accessTokensHandler{
+		accessPolicy:     accessPolicy,
+		sessionStore:     sessionStore,
+		accessTokenStore: accessTokenStore,
+		notificationBus:  notificationBus,
+	}
+}
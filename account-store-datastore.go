@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreAccountStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreAccountStore(c *datastore.Client) *datastoreAccountStore {
+	return &datastoreAccountStore{
+		c: c,
+	}
+}
+
+func accountKey(username string) *datastore.Key {
+	return datastore.NameKey(accountKind, username, nil)
+}
+
+func (s *datastoreAccountStore) Create(ctx context.Context, account *localAccount) error {
+	key := accountKey(account.Username)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var existing localAccount
+
+		if err := tx.Get(key, &existing); err == nil {
+			return errorAccountExists
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := tx.Put(key, account)
+
+		return err
+	})
+
+	return err
+}
+
+func (s *datastoreAccountStore) Lookup(ctx context.Context, username string) (*localAccount, error) {
+	var account localAccount
+
+	if err := s.c.Get(ctx, accountKey(username), &account); err == datastore.ErrNoSuchEntity {
+		return nil, errorAccountNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (s *datastoreAccountStore) Update(ctx context.Context, username string, f func(account *localAccount) error) (*localAccount, error) {
+	key := accountKey(username)
+
+	var account localAccount
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &account); err == datastore.ErrNoSuchEntity {
+			return errorAccountNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if err := f(&account); err != nil {
+			return err
+		}
+
+		_, err := tx.Put(key, &account)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (s *datastoreAccountStore) Reassign(ctx context.Context, from string, to string) error {
+	var accounts []*localAccount
+
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(accountKind).Filter("User =", from), &accounts)
+
+	if err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		account.User = to
+	}
+
+	return datastoreBatches(len(keys), func(start int, end int) error {
+		_, err := s.c.PutMulti(ctx, keys[start:end], accounts[start:end])
+
+		return err
+	})
+}
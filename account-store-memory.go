@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryAccountStore keeps accounts for the lifetime of the process
+type memoryAccountStore struct {
+	lock     sync.Mutex
+	accounts map[string]localAccount
+}
+
+func newMemoryAccountStore() *memoryAccountStore {
+	return &memoryAccountStore{
+		accounts: make(map[string]localAccount),
+	}
+}
+
+func (s *memoryAccountStore) Create(ctx context.Context, account *localAccount) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.accounts[account.Username]; found {
+		return errorAccountExists
+	}
+
+	s.accounts[account.Username] = *account
+
+	return nil
+}
+
+func (s *memoryAccountStore) Lookup(ctx context.Context, username string) (*localAccount, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, found := s.accounts[username]
+
+	if !found {
+		return nil, errorAccountNotFound
+	}
+
+	return &account, nil
+}
+
+func (s *memoryAccountStore) Update(ctx context.Context, username string, f func(account *localAccount) error) (*localAccount, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, found := s.accounts[username]
+
+	if !found {
+		return nil, errorAccountNotFound
+	}
+
+	if err := f(&account); err != nil {
+		return nil, err
+	}
+
+	s.accounts[username] = account
+
+	return &account, nil
+}
+
+func (s *memoryAccountStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for username, account := range s.accounts {
+		if account.User == from {
+			account.User = to
+			s.accounts[username] = account
+		}
+	}
+
+	return nil
+}
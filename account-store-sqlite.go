@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+type sqliteAccountStore struct {
+	db *sql.DB
+}
+
+func newSQLiteAccountStore(db *sql.DB) *sqliteAccountStore {
+	return &sqliteAccountStore{
+		db: db,
+	}
+}
+
+const sqliteAccountColumns = "username, user, email, password_hash, created, password_changed, failed_logins, locked_until"
+
+func scanSQLiteAccount(row sqliteScanner) (*localAccount, error) {
+	var account localAccount
+
+	var created, passwordChanged, lockedUntil int64
+
+	if err := row.Scan(&account.Username, &account.User, &account.Email, &account.PasswordHash, &created, &passwordChanged, &account.FailedLogins, &lockedUntil); err != nil {
+		return nil, err
+	}
+
+	account.Created = fromSQLiteTime(created)
+	account.PasswordChanged = fromSQLiteTime(passwordChanged)
+	account.LockedUntil = fromSQLiteTime(lockedUntil)
+
+	return &account, nil
+}
+
+func (s *sqliteAccountStore) Create(ctx context.Context, account *localAccount) error {
+	result, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO local_accounts ("+sqliteAccountColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		account.Username, account.User, account.Email, account.PasswordHash, sqliteTime(account.Created), sqliteTime(account.PasswordChanged), account.FailedLogins, sqliteTime(account.LockedUntil))
+
+	if err != nil {
+		return err
+	}
+
+	if err := sqliteRequireUpdate(result); err == errorTokenNotFound {
+		return errorAccountExists
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqliteAccountStore) Lookup(ctx context.Context, username string) (*localAccount, error) {
+	account, err := scanSQLiteAccount(s.db.QueryRowContext(ctx, "SELECT "+sqliteAccountColumns+" FROM local_accounts WHERE username = ?", username))
+
+	if err == sql.ErrNoRows {
+		return nil, errorAccountNotFound
+	}
+
+	return account, err
+}
+
+func (s *sqliteAccountStore) Update(ctx context.Context, username string, f func(account *localAccount) error) (*localAccount, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	account, err := scanSQLiteAccount(tx.QueryRowContext(ctx, "SELECT "+sqliteAccountColumns+" FROM local_accounts WHERE username = ?", username))
+
+	if err == sql.ErrNoRows {
+		return nil, errorAccountNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := f(account); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE local_accounts SET user = ?, email = ?, password_hash = ?, password_changed = ?, failed_logins = ?, locked_until = ? WHERE username = ?",
+		account.User, account.Email, account.PasswordHash, sqliteTime(account.PasswordChanged), account.FailedLogins, sqliteTime(account.LockedUntil), username); err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+func (s *sqliteAccountStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE local_accounts SET user = ? WHERE user = ?", to, from)
+
+	return err
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errorAccountNotFound = errors.New("Account not found")
+
+var errorAccountExists = errors.New("Account already exists")
+
+// AccountStore persists local accounts, keyed by their normalised user name
+type AccountStore interface {
+	// Create stores a new account, returning errorAccountExists if the user name is taken
+	Create(ctx context.Context, account *localAccount) error
+	// Lookup finds an account, returning errorAccountNotFound if there is none
+	Lookup(ctx context.Context, username string) (*localAccount, error)
+	// Update applies f to an account atomically, returning errorAccountNotFound if there is none
+	Update(ctx context.Context, username string, f func(account *localAccount) error) (*localAccount, error)
+	// Reassign moves the account with a user ID to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const accountKind = "LocalAccount"
+
+const accountsPath = "/accounts"
+
+const accountRegisterPath = accountsPath + "/register"
+
+const accountLoginPath = accountsPath + "/login"
+
+const accountPasswordPath = accountsPath + "/password"
+
+// localUserKeyPrefix qualifies local user names in user keys, as issuers qualify the subjects of other providers
+const localUserKeyPrefix = "local "
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 64
+	minPasswordLength = 8
+	maxPasswordLength = 256
+)
+
+// Failed logins lock an account for a while, against guessing passwords
+const (
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+)
+
+// Limits on login and registration attempts per address, against spending all our time hashing
+const (
+	accountAttemptLimit  = 20
+	accountAttemptWindow = time.Minute
+)
+
+// argon2id parameters, as recommended by OWASP
+const (
+	argon2Time     = 2
+	argon2Memory   = 19 * 1024
+	argon2Threads  = 1
+	argon2KeySize  = 32
+	argon2SaltSize = 16
+)
+
+var errorInvalidUsername = fmt.Errorf("User names must be %d to %d lower case letters, digits, dots, dashes or underscores", minUsernameLength, maxUsernameLength)
+
+var errorInvalidPassword = fmt.Errorf("Passwords must be %d to %d bytes long", minPasswordLength, maxPasswordLength)
+
+var errorWrongPassword = errors.New("Wrong user name or password")
+
+var errorPasswordHashFormat = errors.New("Unknown password hash format")
+
+type localAccount struct {
+	Username string
+	// User is the user ID hash, derived from the user name as those of other providers are derived from their subjects
+	User string
+	// Email was given unverified when registering, so it is kept for older accounts but never trusted
+	Email string
+	// PasswordHash is an argon2id hash in the PHC string format
+	PasswordHash    string `datastore:",noindex"`
+	Created         time.Time
+	PasswordChanged time.Time
+	FailedLogins    int
+	LockedUntil     time.Time
+}
+
+type accountRegistration struct {
+	Username string
+	Password string
+}
+
+type accountLogin struct {
+	Username string
+	Password string
+}
+
+type passwordChange struct {
+	Username        string
+	CurrentPassword string
+	NewPassword     string
+}
+
+// dummyPasswordHash is checked against when there is no such account, so that logins take as long either way
+var dummyPasswordHash = hashPassword("dummy password", make([]byte, argon2SaltSize))
+
+func hashPassword(password string, salt []byte) string {
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeySize)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func newPasswordHash(password string) (string, error) {
+	salt := make([]byte, argon2SaltSize)
+
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+
+	return hashPassword(password, salt), nil
+}
+
+// checkPassword compares a password with a hash, using the parameters recorded in the hash so they can be raised later
+func checkPassword(password string, passwordHash string) (bool, error) {
+	parts := strings.Split(passwordHash, "$")
+
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errorPasswordHashFormat
+	}
+
+	var version int
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errorPasswordHashFormat
+	}
+
+	var memory, iterations uint32
+
+	var threads uint8
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errorPasswordHashFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return false, errorPasswordHashFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil {
+		return false, errorPasswordHashFormat
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1, nil
+}
+
+// normalizeUsername makes user names case insensitive, and checks they are made of safe characters
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return "", errorInvalidUsername
+	}
+
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return "", errorInvalidUsername
+		}
+	}
+
+	return username, nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errorInvalidPassword
+	}
+
+	return nil
+}
+
+func localUserKey(username string) string {
+	return localUserKeyPrefix + username
+}
+
+// verifiedEmail gives the email a user signed in with if an identity provider verified it.
+// Local users gave theirs unverified, and users from before user keys were recorded may have been local users.
+func verifiedEmail(email string, userKey string) string {
+	if userKey == "" || strings.HasPrefix(userKey, localUserKeyPrefix) {
+		return ""
+	}
+
+	return email
+}
+
+type accountsHandler struct {
+	registrationOpen bool
+	accessPolicy     *AccessPolicy
+	notificationBus  NotificationBus
+	sessionStore     SessionStore
+	accountStore     AccountStore
+	userIDs          *UserIDs
+	attemptLimiter   *rateLimiter
+	// trustedProxies is how many proxies in front of the server append to X-Forwarded-For
+	trustedProxies int
+}
+
+func (h *accountsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case accountRegisterPath:
+		h.register(w, r)
+	case accountLoginPath:
+		h.login(w, r)
+	case accountPasswordPath:
+		h.changePassword(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// startSession logs in to an account, as the Google path does after verifying a token.
+// Nobody has verified a local user's email, so their sessions have none.
+func (h *accountsHandler) startSession(w http.ResponseWriter, r *http.Request, account *localAccount) {
+	session, err := genToken(r.Context(), h.sessionStore, account.User, localUserKey(account.Username), "", requestDevice(r))
+
+	if err != nil {
+		log.Println("Failed to generate token:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Local user", account.Username, "logged in as", account.User)
+
+	setSessionCookie(w, session)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&sessionLogin{
+		Email:     session.Email,
+		Expiry:    session.Expiry,
+		CSRFToken: session.CSRFToken,
+	}); err != nil {
+		log.Println("Error writing session:", err)
+	}
+}
+
+func (h *accountsHandler) register(w http.ResponseWriter, r *http.Request) {
+	if !h.registrationOpen {
+		http.Error(w, "Registration is closed", http.StatusForbidden)
+		return
+	}
+
+	if !h.attemptLimiter.Allow(trustedIP(r, h.trustedProxies)) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var registration accountRegistration
+
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	username, err := normalizeUsername(registration.Username)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validatePassword(registration.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userKey := localUserKey(username)
+
+	if err := h.accessPolicy.Check("", userKey); err != nil {
+		log.Println("Refused registration of", username+":", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	passwordHash, err := newPasswordHash(registration.Password)
+
+	if err != nil {
+		log.Println("Error hashing password:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+
+	account := &localAccount{
+		Username:        username,
+		User:            h.userIDs.Hash(userKey),
+		PasswordHash:    passwordHash,
+		Created:         now,
+		PasswordChanged: now,
+	}
+
+	if err := h.accountStore.Create(r.Context(), account); err == errorAccountExists {
+		http.Error(w, "User name taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Println("Error creating account:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("Registered local user", username)
+
+	h.startSession(w, r, account)
+}
+
+// authenticate checks a password, locking the account after too many failures
+func (h *accountsHandler) authenticate(r *http.Request, username string, password string) (*localAccount, error) {
+	account, err := h.accountStore.Lookup(r.Context(), username)
+
+	if err == errorAccountNotFound {
+		checkPassword(password, dummyPasswordHash)
+		return nil, errorWrongPassword
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The password is checked even while the account is locked, and a locked account fails like a wrong password,
+	// so that neither the response nor its timing tells whether the user name exists
+	correct, err := checkPassword(password, account.PasswordHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if now.Before(account.LockedUntil) {
+		return nil, errorWrongPassword
+	}
+
+	account, err = h.accountStore.Update(r.Context(), username, func(account *localAccount) error {
+		if correct {
+			account.FailedLogins = 0
+			return nil
+		}
+
+		account.FailedLogins++
+
+		if account.FailedLogins >= maxFailedLogins {
+			account.FailedLogins = 0
+			account.LockedUntil = now.Add(lockoutDuration)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !correct {
+		if account.LockedUntil.After(now) {
+			log.Println("Locked local user", username, "after repeated failed logins")
+		}
+
+		return nil, errorWrongPassword
+	}
+
+	return account, nil
+}
+
+func (h *accountsHandler) login(w http.ResponseWriter, r *http.Request) {
+	if !h.attemptLimiter.Allow(trustedIP(r, h.trustedProxies)) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var login accountLogin
+
+	if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	username, err := normalizeUsername(login.Username)
+
+	if err != nil {
+		http.Error(w, errorWrongPassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	account, err := h.authenticate(r, username, login.Password)
+
+	if err == errorWrongPassword {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("Error logging in:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.accessPolicy.Check("", localUserKey(account.Username)); err != nil {
+		log.Println("Refused local user", account.Username+":", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := h.userIDs.Track(r.Context(), localUserKey(account.Username), account.User); err != nil {
+		log.Println("Error tracking user ID migration:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.startSession(w, r, account)
+}
+
+// changePassword replaces the password of the signed in user's account, ending their other sessions
+func (h *accountsHandler) changePassword(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var change passwordChange
+
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if err := validatePassword(change.NewPassword); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username, err := normalizeUsername(change.Username)
+
+	if err != nil {
+		http.Error(w, errorWrongPassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	account, err := h.authenticate(r, username, change.CurrentPassword)
+
+	if err == errorWrongPassword {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Println("Error checking password:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if account.User != session.User {
+		http.Error(w, errorWrongPassword.Error(), http.StatusForbidden)
+		return
+	}
+
+	passwordHash, err := newPasswordHash(change.NewPassword)
+
+	if err != nil {
+		log.Println("Error hashing password:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := h.accountStore.Update(r.Context(), username, func(account *localAccount) error {
+		account.PasswordHash = passwordHash
+		account.PasswordChanged = time.Now()
+		return nil
+	}); err != nil {
+		log.Println("Error changing password:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	cookies, err := h.sessionStore.List(r.Context(), session.User)
+
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+	}
+
+	for _, cookie := range cookies {
+		if cookie.ID == session.ID || cookie.ID == "" {
+			continue
+		}
+
+		if err := h.sessionStore.RevokeByID(r.Context(), session.User, cookie.ID); err != nil && err != errorTokenNotFound {
+			log.Println("Error revoking session:", err)
+			continue
+		}
+
+		if err := publishSessionRevoked(r.Context(), h.notificationBus, session.User, cookie.ID); err != nil {
+			log.Println("Error publishing session revocation:", err)
+		}
+	}
+
+	log.Println("Local user", username, "changed their password")
+
+	fmt.Fprintln(w, "Password changed")
+}
+
+func loadRegistrationOpen() (bool, error) {
+	registrationText, registrationDeclared := os.LookupEnv("LOCAL_REGISTRATION")
+
+	if !registrationDeclared {
+		log.Println("Local registration not declared, defaulting to closed")
+		return false, nil
+	}
+
+	return strconv.ParseBool(registrationText)
+}
+
+// AccountsHandler handles registering local accounts, logging in to them and changing their passwords, under its subpaths
+func AccountsHandler(registrationOpen bool, accessPolicy *AccessPolicy, notificationBus NotificationBus, sessionStore SessionStore, accountStore AccountStore, userIDs *UserIDs, trustedProxies int) (string, http.Handler) {
+	return accountsPath + "/", &accountsHandler{
+		registrationOpen: registrationOpen,
+		accessPolicy:     accessPolicy,
+		notificationBus:  notificationBus,
+		sessionStore:     sessionStore,
+		accountStore:     accountStore,
+		userIDs:          userIDs,
+		attemptLimiter:   newRateLimiter(accountAttemptLimit, accountAttemptWindow),
+		trustedProxies:   trustedProxies,
+	}
+}
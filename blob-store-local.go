@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+const localBlobMetaSuffix = ".meta"
+
+const localBlobTempPrefix = ".upload-"
+
+var errorInvalidBlobName = errors.New("Invalid blob name")
+
+type localBlobMeta struct {
+	ContentType string
+	Metadata    map[string]string
+	Created     time.Time
+}
+
+// localBlobStore keeps blobs as files under a directory, with their metadata in sidecar files
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+
+	return &localBlobStore{
+		root: root,
+	}, nil
+}
+
+func (s *localBlobStore) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, localBlobMetaSuffix) {
+		return "", errorInvalidBlobName
+	}
+
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." || strings.HasPrefix(element, localBlobTempPrefix) {
+			return "", errorInvalidBlobName
+		}
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+func writeFileAtomically(path string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), localBlobTempPrefix)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (s *localBlobStore) Write(ctx context.Context, name string, r io.Reader, opts BlobWriteOptions) (*BlobAttrs, error) {
+	path, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	meta := localBlobMeta{
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+		Created:     time.Now().UTC(),
+	}
+
+	bufferedReader := bufio.NewReader(r)
+
+	if meta.ContentType == "" {
+		head, _ := bufferedReader.Peek(512)
+		meta.ContentType = http.DetectContentType(head)
+	}
+
+	if err := writeFileAtomically(path, bufferedReader); err != nil {
+		return nil, err
+	}
+
+	metaData, err := json.Marshal(&meta)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomically(path+localBlobMetaSuffix, strings.NewReader(string(metaData))); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return s.Attrs(ctx, name)
+}
+
+func (s *localBlobStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, errorBlobNotFound
+	}
+
+	return f, err
+}
+
+// localRangeReader reads part of a local blob
+type localRangeReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *localRangeReader) Close() error {
+	return r.f.Close()
+}
+
+func (s *localBlobStore) NewRangeReader(ctx context.Context, name string, offset int64, length int64) (io.ReadCloser, error) {
+	path, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, errorBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if length < 0 {
+		return file, nil
+	}
+
+	return &localRangeReader{
+		Reader: io.LimitReader(file, length),
+		f:      file,
+	}, nil
+}
+
+type localBlobIterator struct {
+	ctx   context.Context
+	store *localBlobStore
+	names []string
+	err   error
+}
+
+func (i *localBlobIterator) Next() (*BlobAttrs, error) {
+	if i.err != nil {
+		return nil, i.err
+	}
+
+	for len(i.names) > 0 {
+		name := i.names[0]
+		i.names = i.names[1:]
+
+		attrs, err := i.store.Attrs(i.ctx, name)
+
+		if err == errorBlobNotFound {
+			// Deleted since the listing was taken
+			continue
+		}
+
+		return attrs, err
+	}
+
+	return nil, iterator.Done
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) BlobIterator {
+	names := []string{}
+
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(path, localBlobMetaSuffix) || strings.HasPrefix(info.Name(), localBlobTempPrefix) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.root, path)
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(relPath)
+
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+
+		return nil
+	})
+
+	sort.Strings(names)
+
+	return &localBlobIterator{
+		ctx:   ctx,
+		store: s,
+		names: names,
+		err:   err,
+	}
+}
+
+func (s *localBlobStore) Attrs(ctx context.Context, name string) (*BlobAttrs, error) {
+	path, err := s.path(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+
+	if os.IsNotExist(err) {
+		return nil, errorBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	metaData, err := ioutil.ReadFile(path + localBlobMetaSuffix)
+
+	if os.IsNotExist(err) {
+		return nil, errorBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var meta localBlobMeta
+
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, err
+	}
+
+	return &BlobAttrs{
+		Name:        name,
+		ContentType: meta.ContentType,
+		Metadata:    meta.Metadata,
+		Created:     meta.Created,
+		Size:        info.Size(),
+	}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	path, err := s.path(name)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return errorBlobNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path + localBlobMetaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *localBlobStore) Rename(ctx context.Context, from string, to string) error {
+	fromPath, err := s.path(from)
+
+	if err != nil {
+		return err
+	}
+
+	toPath, err := s.path(to)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(toPath), 0700); err != nil {
+		return err
+	}
+
+	// The metadata is moved first, so that an interrupted rename leaves a blob without metadata, which is not listed
+	if err := os.Rename(fromPath+localBlobMetaSuffix, toPath+localBlobMetaSuffix); os.IsNotExist(err) {
+		return errorBlobNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return os.Rename(fromPath, toPath)
+}
+
+// SignedURL is unsupported, as the blobs are only served by the app
+func (s *localBlobStore) SignedURL(name string, opts BlobURLOptions) (string, error) {
+	return "", errorSignedURLUnsupported
+}
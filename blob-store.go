@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+var errorBlobNotFound = errors.New("Blob not found")
+
+var errorSignedURLUnsupported = errors.New("Signed URLs not supported")
+
+// BlobAttrs describes a stored blob and its metadata
+type BlobAttrs struct {
+	Name        string
+	ContentType string
+	Metadata    map[string]string
+	Created     time.Time
+	Size        int64
+}
+
+// BlobWriteOptions describes the attributes of a blob being written
+type BlobWriteOptions struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// BlobURLOptions describes a signed URL to read a blob from, and the headers it is served with
+type BlobURLOptions struct {
+	Expiry             time.Time
+	ContentType        string
+	ContentDisposition string
+}
+
+// BlobIterator iterates over blobs, returning iterator.Done when there are no more
+type BlobIterator interface {
+	Next() (*BlobAttrs, error)
+}
+
+// BlobStore stores file contents along with their metadata
+type BlobStore interface {
+	Write(ctx context.Context, name string, r io.Reader, opts BlobWriteOptions) (*BlobAttrs, error)
+	NewReader(ctx context.Context, name string) (io.ReadCloser, error)
+	// NewRangeReader reads length bytes of a blob from offset, or the rest of the blob if length is negative
+	NewRangeReader(ctx context.Context, name string, offset int64, length int64) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) BlobIterator
+	Attrs(ctx context.Context, name string) (*BlobAttrs, error)
+	Delete(ctx context.Context, name string) error
+	// Rename moves a blob, keeping its metadata
+	Rename(ctx context.Context, from string, to string) error
+	// SignedURL gives a URL the blob can be read from directly until it expires, or errorSignedURLUnsupported
+	SignedURL(name string, opts BlobURLOptions) (string, error)
+}
+
+func openBlobStore(ctx context.Context, projectID string) (BlobStore, error) {
+	blobStoreKind, blobStoreKindDeclared := os.LookupEnv("BLOB_STORE")
+
+	if !blobStoreKindDeclared {
+		blobStoreKind = "gcs"
+		log.Println("Blob store not declared, defaulting to", blobStoreKind)
+	}
+
+	switch blobStoreKind {
+	case "gcs":
+		if projectID == "" {
+			return nil, errors.New("Project ID not declared")
+		}
+
+		storageBucketName, storageBucketNameDeclared := os.LookupEnv("STORAGE_BUCKET")
+
+		if !storageBucketNameDeclared {
+			return nil, errors.New("Storage Bucket not declared")
+		}
+
+		log.Println("Connecting to FileStore")
+		storageClient, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return newGCSBlobStore(storageClient.Bucket(storageBucketName)), nil
+	case "local":
+		blobStoreDir, blobStoreDirDeclared := os.LookupEnv("BLOB_STORE_DIR")
+
+		if !blobStoreDirDeclared {
+			return nil, errors.New("Blob store directory not declared")
+		}
+
+		log.Println("Using local blob store in", blobStoreDir)
+		return newLocalBlobStore(blobStoreDir)
+	default:
+		return nil, fmt.Errorf("Unknown blob store %q", blobStoreKind)
+	}
+}
+
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSBlobStore(bucket *storage.BucketHandle) *gcsBlobStore {
+	return &gcsBlobStore{
+		bucket: bucket,
+	}
+}
+
+func gcsBlobAttrs(objAttrs *storage.ObjectAttrs) *BlobAttrs {
+	return &BlobAttrs{
+		Name:        objAttrs.Name,
+		ContentType: objAttrs.ContentType,
+		Metadata:    objAttrs.Metadata,
+		Created:     objAttrs.Created,
+		Size:        objAttrs.Size,
+	}
+}
+
+func (s *gcsBlobStore) Write(ctx context.Context, name string, r io.Reader, opts BlobWriteOptions) (*BlobAttrs, error) {
+	ctx, cancelCtx := context.WithCancel(ctx)
+
+	defer cancelCtx()
+
+	objWriter := s.bucket.Object(name).NewWriter(ctx)
+
+	objWriter.ContentType = opts.ContentType
+	objWriter.Metadata = opts.Metadata
+
+	if _, err := io.Copy(objWriter, r); err != nil {
+		// Cancelling the context aborts the upload
+		return nil, err
+	}
+
+	if err := objWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return gcsBlobAttrs(objWriter.Attrs()), nil
+}
+
+func (s *gcsBlobStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	objReader, err := s.bucket.Object(name).NewReader(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errorBlobNotFound
+	}
+
+	return objReader, err
+}
+
+func (s *gcsBlobStore) NewRangeReader(ctx context.Context, name string, offset int64, length int64) (io.ReadCloser, error) {
+	objReader, err := s.bucket.Object(name).NewRangeReader(ctx, offset, length)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errorBlobNotFound
+	}
+
+	return objReader, err
+}
+
+func (s *gcsBlobStore) SignedURL(name string, opts BlobURLOptions) (string, error) {
+	return s.bucket.SignedURL(name, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  "GET",
+		Expires: opts.Expiry,
+		QueryParameters: url.Values{
+			"response-content-type":        {opts.ContentType},
+			"response-content-disposition": {opts.ContentDisposition},
+		},
+	})
+}
+
+type gcsBlobIterator struct {
+	it *storage.ObjectIterator
+}
+
+func (i *gcsBlobIterator) Next() (*BlobAttrs, error) {
+	objAttrs, err := i.it.Next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gcsBlobAttrs(objAttrs), nil
+}
+
+func (s *gcsBlobStore) List(ctx context.Context, prefix string) BlobIterator {
+	return &gcsBlobIterator{
+		it: s.bucket.Objects(ctx, &storage.Query{Prefix: prefix}),
+	}
+}
+
+func (s *gcsBlobStore) Attrs(ctx context.Context, name string) (*BlobAttrs, error) {
+	objAttrs, err := s.bucket.Object(name).Attrs(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return nil, errorBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return gcsBlobAttrs(objAttrs), nil
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return errorBlobNotFound
+	}
+
+	return err
+}
+
+func (s *gcsBlobStore) Rename(ctx context.Context, from string, to string) error {
+	src := s.bucket.Object(from)
+
+	srcAttrs, err := src.Attrs(ctx)
+
+	if err == storage.ErrObjectNotExist {
+		return errorBlobNotFound
+	} else if err != nil {
+		return err
+	}
+
+	copier := s.bucket.Object(to).CopierFrom(src)
+
+	// Copies get the bucket's default ACL unless given the source's
+	copier.ACL = srcAttrs.ACL
+
+	if _, err := copier.Run(ctx); err != nil {
+		return err
+	}
+
+	return src.Delete(ctx)
+}
+
+// blobReadSeeker reads a blob of a known size, starting a range read wherever it is seeked to
+type blobReadSeeker struct {
+	ctx       context.Context
+	blobStore BlobStore
+	name      string
+	size      int64
+	offset    int64
+	reader    io.ReadCloser
+}
+
+func newBlobReadSeeker(ctx context.Context, blobStore BlobStore, name string, size int64) *blobReadSeeker {
+	return &blobReadSeeker{
+		ctx:       ctx,
+		blobStore: blobStore,
+		name:      name,
+		size:      size,
+	}
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		if b.offset >= b.size {
+			return 0, io.EOF
+		}
+
+		reader, err := b.blobStore.NewRangeReader(b.ctx, b.name, b.offset, -1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		b.reader = reader
+	}
+
+	n, err := b.reader.Read(p)
+
+	b.offset += int64(n)
+
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("Seek before start of blob")
+	}
+
+	if offset != b.offset && b.reader != nil {
+		b.reader.Close()
+		b.reader = nil
+	}
+
+	b.offset = offset
+
+	return offset, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.reader == nil {
+		return nil
+	}
+
+	return b.reader.Close()
+}
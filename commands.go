@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/iterator"
+)
+
+// runCommand runs a maintenance command against the configured backends instead of serving
+func runCommand(ctx context.Context, args []string, notificationBus NotificationBus, blobStore BlobStore, stores *Stores) error {
+	switch args[0] {
+	case "migrate-user-ids":
+		return migrateUserIDs(ctx, notificationBus, blobStore, stores)
+	case "reconcile-items":
+		return reconcileItems(ctx, blobStore, stores)
+	case "set-quota":
+		return setQuota(ctx, args[1:], stores.Usage)
+	default:
+		return fmt.Errorf("Unknown command %q", args[0])
+	}
+}
+
+// migrateUserIDs moves the data of users found under IDs from older secrets to their current IDs.
+// Their sessions under the old ID are revoked, so they sign in again under the new one.
+func migrateUserIDs(ctx context.Context, notificationBus NotificationBus, blobStore BlobStore, stores *Stores) error {
+	migrations, err := stores.UserIDMigrations.List(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("Migrating", len(migrations), "user IDs")
+
+	for _, migration := range migrations {
+		if err := migrateUserID(ctx, notificationBus, blobStore, stores, migration); err != nil {
+			return fmt.Errorf("migrating %s: %w", migration.From, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateUserID(ctx context.Context, notificationBus NotificationBus, blobStore BlobStore, stores *Stores, migration *userIDMigration) error {
+	log.Println("Migrating user", migration.From, "to", migration.To)
+
+	if err := stores.AccessTokens.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Passkeys.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Accounts.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	// Revoking sessions before moving items stops them uploading under the old ID
+	sessions, err := stores.Sessions.List(ctx, migration.From)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if err := stores.Sessions.RevokeByID(ctx, migration.From, session.ID); err != nil && err != errorTokenNotFound {
+			return err
+		}
+
+		if err := publishSessionRevoked(ctx, notificationBus, migration.From, session.ID); err != nil {
+			log.Println("Error publishing session revocation:", err)
+		}
+	}
+
+	objIter := blobStore.List(ctx, migration.From+"/")
+
+	for {
+		attrs, err := objIter.Next()
+
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		to := migration.To + strings.TrimPrefix(attrs.Name, migration.From)
+
+		if err := blobStore.Rename(ctx, attrs.Name, to); err != nil && err != errorBlobNotFound {
+			return err
+		}
+	}
+
+	if err := stores.Items.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Retention.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Usage.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Shares.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := stores.Directory.Reassign(ctx, migration.From, migration.To); err != nil {
+		return err
+	}
+
+	if err := notificationBus.DeleteTopic(ctx, migration.From); err != nil {
+		return err
+	}
+
+	return stores.UserIDMigrations.Delete(ctx, migration.From)
+}
+
+// reconcileItems rebuilds the item index from the blob store, indexing every item's blob and removing entries without one.
+// Users' usage is counted again from the items found.
+func reconcileItems(ctx context.Context, blobStore BlobStore, stores *Stores) error {
+	itemStore := stores.Items
+
+	found := make(map[string]bool)
+
+	usage := make(map[string]*userUsage)
+
+	objIter := blobStore.List(ctx, "")
+
+	for {
+		attrs, err := objIter.Next()
+
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		user, id := splitObjectName(attrs.Name)
+
+		if user == "" || checkItemID(id) != nil {
+			log.Println("Skipping blob", attrs.Name, "which is not an item")
+			continue
+		}
+
+		body := ""
+
+		if attrs.ContentType == clipboardMimeType {
+			body, err = readBlobText(ctx, blobStore, attrs.Name)
+
+			if err == errorBlobNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if err := itemStore.Put(ctx, newClipItem(attrs, body)); err != nil {
+			return err
+		}
+
+		found[attrs.Name] = true
+
+		if usage[user] == nil {
+			usage[user] = &userUsage{}
+		}
+
+		usage[user].Bytes += attrs.Size
+		usage[user].Items++
+	}
+
+	objects, err := itemStore.Objects(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+
+	for _, object := range objects {
+		if found[object] {
+			continue
+		}
+
+		if _, err := itemStore.Delete(ctx, object); err != nil && err != errorItemNotFound {
+			return err
+		}
+
+		removed++
+	}
+
+	log.Println("Indexed", len(found), "items and removed", removed, "entries without blobs")
+
+	counted, err := stores.Usage.List(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// Users who no longer have any items are counted as empty
+	for _, previous := range counted {
+		if usage[previous.User] == nil {
+			usage[previous.User] = &userUsage{}
+		}
+	}
+
+	for user, recount := range usage {
+		if _, err := stores.Usage.Update(ctx, user, func(usage *userUsage) error {
+			usage.Bytes = recount.Bytes
+			usage.Items = recount.Items
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setQuota overrides the quota of a user, given as the user ID and the limits on bytes, items and item size.
+// A limit of 0 uses the default, and a negative limit is no limit.
+func setQuota(ctx context.Context, args []string, usageStore UsageStore) error {
+	if len(args) != 4 {
+		return errors.New("usage: set-quota USER MAX_BYTES MAX_ITEMS MAX_ITEM_SIZE")
+	}
+
+	var limits [3]int64
+
+	for i, limitText := range args[1:] {
+		limit, err := strconv.ParseInt(limitText, 10, 64)
+
+		if err != nil {
+			return err
+		}
+
+		limits[i] = limit
+	}
+
+	usage, err := usageStore.Update(ctx, args[0], func(usage *userUsage) error {
+		usage.MaxBytes = limits[0]
+		usage.MaxItems = int(limits[1])
+		usage.MaxItemSize = limits[2]
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("Set quota of user", usage.User, "to", usage.MaxBytes, "bytes,", usage.MaxItems, "items and", usage.MaxItemSize, "bytes per item")
+
+	return nil
+}
@@ -3,43 +3,172 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
-
-	"cloud.google.com/go/datastore"
-	"google.golang.org/api/iterator"
+	"unicode/utf8"
 )
 
 const cookieKind = "SessionCookie"
 
 const tokenSize = 256
 
+const csrfTokenSize = 32
+
+const sessionIDSize = 16
+
+const maxDeviceNameLength = 100
+
+// maxUserAgentLength and maxIPLength bound what clients can make sessions store about them
+const (
+	maxUserAgentLength = 512
+	maxIPLength        = 64
+)
+
+// tokenTimeout is how long a session lasts without being used
 const tokenTimeout = time.Hour
 
+// sessionMaxLifetime is how long a session lasts however often it is used
+const sessionMaxLifetime = 30 * 24 * time.Hour
+
+const sessionCookieName = "session"
+
+const csrfHeaderName = "X-CSRF-Token"
+
 var errorTokenErpired = errors.New("Token Expired")
 
+var errorNoSessionCookie = errors.New("No session cookie")
+
+var errorCrossOrigin = errors.New("Cross origin request")
+
+var errorCSRFTokenWrong = errors.New("CSRF token wrong")
+
 type sessionCookie struct {
-	User   string
-	Email  string
-	Token  string
+	User string
+	// UserKey identifies the user to the access policy, and is empty for sessions from before it was recorded
+	UserKey string
+	Email   string
+	// Token is never stored, sessions are keyed by its hash instead
+	Token  string `datastore:"-"`
 	Expiry time.Time
+	// CSRFToken must accompany state changing requests made with the session cookie
+	CSRFToken string
+	Created   time.Time
+	// ID identifies the session to its user without granting access to it
+	ID         string
+	DeviceName string `datastore:",noindex"`
+	UserAgent  string `datastore:",noindex"`
+	IP         string `datastore:",noindex"`
+	LastSeen   time.Time
 }
 
-const cookieCleanPath = "/cleanup"
+// sessionDevice describes where a session was started
+type sessionDevice struct {
+	Name      string
+	UserAgent string
+	IP        string
+}
+
+// remoteIP finds the address the request was received from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// clientIP finds the address of the client, which is only informational as forwarding headers may be forged
+func clientIP(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+
+	return remoteIP(r)
+}
 
-func getUser(ctx context.Context, c *datastore.Client, token string) (user string, email string, err error) {
-	query := datastore.NewQuery(cookieKind).Filter("Token =", token).Limit(1)
+// trustedIP finds the address of the client for rate limits, trusting only the forwarding header entries added by our own proxies.
+// Each proxy appends the address it was connected from, so the entry before those of the trusted proxies cannot be forged.
+func trustedIP(r *http.Request, trustedProxies int) string {
+	if trustedProxies == 0 {
+		return remoteIP(r)
+	}
+
+	var forwardedFor []string
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(header, ",")...)
+	}
 
-	it := c.Run(ctx, query)
+	if len(forwardedFor) < trustedProxies {
+		return remoteIP(r)
+	}
+
+	return strings.TrimSpace(forwardedFor[len(forwardedFor)-trustedProxies])
+}
 
-	var cookie sessionCookie
+// loadTrustedProxies reads how many proxies in front of the server append to X-Forwarded-For
+func loadTrustedProxies() (int, error) {
+	proxiesText, proxiesDeclared := os.LookupEnv("TRUSTED_PROXIES")
 
-	_, err = it.Next(&cookie)
+	if !proxiesDeclared {
+		log.Println("Trusted proxies not declared, defaulting to none")
+		return 0, nil
+	}
+
+	trustedProxies, err := strconv.Atoi(proxiesText)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if trustedProxies < 0 {
+		return 0, errors.New("negative trusted proxies")
+	}
+
+	return trustedProxies, nil
+}
+
+// truncateText cuts text down to at most maxLength bytes, without splitting a character
+func truncateText(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+
+	end := maxLength
+
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+
+	return text[:end]
+}
+
+func requestDevice(r *http.Request) sessionDevice {
+	return sessionDevice{
+		Name:      truncateText(r.URL.Query().Get("device"), maxDeviceNameLength),
+		UserAgent: truncateText(r.UserAgent(), maxUserAgentLength),
+		IP:        truncateText(clientIP(r), maxIPLength),
+	}
+}
+
+const cookieCleanPath = "/cleanup"
+
+func getSession(ctx context.Context, store SessionStore, token string) (cookie *sessionCookie, err error) {
+	cookie, err = store.Lookup(ctx, token)
 
 	if err != nil {
 		log.Println(err)
@@ -51,12 +180,149 @@ func getUser(ctx context.Context, c *datastore.Client, token string) (user strin
 		return
 	}
 
-	user = cookie.User
-	email = cookie.Email
 	return
 }
 
-func genToken(ctx context.Context, c *datastore.Client, user string, email string) (token string, err error) {
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		// Browsers send an origin with cross origin requests
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+
+	return err == nil && originURL.Host == r.Host
+}
+
+// checkSessionPolicy revokes a session whose user the access policy no longer allows, as the policy can change while sessions last
+func checkSessionPolicy(ctx context.Context, accessPolicy *AccessPolicy, store SessionStore, cookie *sessionCookie) error {
+	if err := accessPolicy.Check(cookie.Email, cookie.UserKey); err != nil {
+		if revokeErr := store.Revoke(ctx, cookie.Token); revokeErr != nil && revokeErr != errorTokenNotFound {
+			log.Println("Error revoking refused session:", revokeErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// getRequestSession finds the session of a request's cookie, checking state changing requests came from our own pages
+// and that the access policy still allows its user
+func getRequestSession(ctx context.Context, accessPolicy *AccessPolicy, store SessionStore, r *http.Request) (*sessionCookie, error) {
+	httpCookie, err := r.Cookie(sessionCookieName)
+
+	if err != nil {
+		return nil, errorNoSessionCookie
+	}
+
+	cookie, err := getSession(ctx, store, httpCookie.Value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSessionPolicy(ctx, accessPolicy, store, cookie); err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if !sameOrigin(r) {
+			return nil, errorCrossOrigin
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeaderName)), []byte(cookie.CSRFToken)) != 1 {
+			return nil, errorCSRFTokenWrong
+		}
+	}
+
+	// Slide the expiry along once half the idle timeout has passed, rather than on every request
+	if time.Until(cookie.Expiry) < tokenTimeout/2 {
+		if err := refreshSession(ctx, store, cookie); err != nil {
+			return nil, err
+		}
+	}
+
+	return cookie, nil
+}
+
+// sessionEnd is when a session expires however often it is used
+func sessionEnd(cookie *sessionCookie) time.Time {
+	if cookie.Created.IsZero() {
+		// Sessions from before creation times were recorded
+		return cookie.Expiry
+	}
+
+	return cookie.Created.Add(sessionMaxLifetime)
+}
+
+// refreshSession extends a session by the idle timeout, up to its maximum lifetime
+func refreshSession(ctx context.Context, store SessionStore, cookie *sessionCookie) error {
+	expiry := time.Now().Add(tokenTimeout)
+
+	if end := sessionEnd(cookie); expiry.After(end) {
+		expiry = end
+	}
+
+	now := time.Now()
+
+	if err := store.Touch(ctx, cookie.Token, expiry, now); err != nil {
+		return err
+	}
+
+	cookie.Expiry = expiry
+	cookie.LastSeen = now
+
+	return nil
+}
+
+// setSessionCookie gives the client the session token, which the server expires sooner if it is left unused
+func setSessionCookie(w http.ResponseWriter, cookie *sessionCookie) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    cookie.Token,
+		Path:     "/",
+		Expires:  sessionEnd(cookie),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// hashToken gives the key a session is stored under, so stored sessions cannot be used to log in
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func randomToken(size int) (string, error) {
+	tokenBytes := make([]byte, size)
+
+	if _, err := io.ReadFull(rand.Reader, tokenBytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+func genToken(ctx context.Context, store SessionStore, user string, userKey string, email string, device sessionDevice) (cookie *sessionCookie, err error) {
 	var tokenBytes [tokenSize]byte
 
 	_, err = io.ReadFull(rand.Reader, tokenBytes[:])
@@ -65,75 +331,84 @@ func genToken(ctx context.Context, c *datastore.Client, user string, email strin
 		return
 	}
 
-	token = base64.StdEncoding.EncodeToString(tokenBytes[:])
+	token := base64.StdEncoding.EncodeToString(tokenBytes[:])
+
+	csrfToken, err := randomToken(csrfTokenSize)
 
-	cookie := sessionCookie{
-		User:   user,
-		Email:  email,
-		Token:  token,
-		Expiry: time.Now().Add(tokenTimeout),
+	if err != nil {
+		return
 	}
 
-	key, err := c.Put(ctx, datastore.IncompleteKey(cookieKind, nil), &cookie)
+	id, err := randomToken(sessionIDSize)
 
 	if err != nil {
 		return
 	}
 
-	go func() {
-		<-ctx.Done()
-		if err := c.Delete(context.Background(), key); err != nil {
-			log.Println("Error removing token:", err)
-			return
-		}
-	}()
+	now := time.Now()
+
+	cookie = &sessionCookie{
+		User:       user,
+		UserKey:    userKey,
+		Email:      email,
+		Token:      token,
+		Expiry:     now.Add(tokenTimeout),
+		CSRFToken:  csrfToken,
+		Created:    now,
+		ID:         id,
+		DeviceName: device.Name,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		LastSeen:   now,
+	}
 
+	err = store.Create(ctx, cookie)
 	return
 }
 
-func cleanupExpiredCookies(ctx context.Context, c *datastore.Client) error {
-	query := datastore.NewQuery(cookieKind)
+func cleanupExpiredCookies(ctx context.Context, stores *Stores) error {
+	now := time.Now()
 
-	it := c.Run(ctx, query)
-
-	var cookie sessionCookie
-
-	keys := []*datastore.Key{}
-
-	for {
-		key, err := it.Next(&cookie)
+	if err := stores.Sessions.DeleteExpired(ctx, now); err != nil {
+		return err
+	}
 
-		if err == iterator.Done {
-			break
-		} else if err != nil {
-			return err
-		}
+	if err := stores.AccessTokens.DeleteExpired(ctx, now); err != nil {
+		return err
+	}
 
-		if time.Now().After(cookie.Expiry) {
-			keys = append(keys, key)
-		}
+	if err := stores.Pairings.DeleteExpired(ctx, now); err != nil {
+		return err
 	}
 
-	return c.DeleteMulti(ctx, keys)
+	return stores.Passkeys.DeleteExpired(ctx, now)
 }
 
 type cleanCookiesHandler struct {
-	c *datastore.Client
+	stores    *Stores
+	cronToken string
 }
 
 func (h *cleanCookiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := cleanupExpiredCookies(r.Context(), h.c); err != nil {
+	if !cronRequest(r, h.cronToken) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := cleanupExpiredCookies(r.Context(), h.stores); err != nil {
 		log.Println("Couldn't clean expired cookies:", err)
 
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	fmt.Fprintln(w, "Cleaned Expired Cookies")
 }
 
-//CleanCookiesHandler handles expired cookies cleanup
-func CleanCookiesHandler(c *datastore.Client) (string, http.Handler) {
+// CleanCookiesHandler handles expired cookies cleanup
+func CleanCookiesHandler(stores *Stores, cronToken string) (string, http.Handler) {
 	return cookieCleanPath, &cleanCookiesHandler{
-		c: c,
+		stores:    stores,
+		cronToken: cronToken,
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreDirectoryStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreDirectoryStore(c *datastore.Client) *datastoreDirectoryStore {
+	return &datastoreDirectoryStore{
+		c: c,
+	}
+}
+
+func directoryEntryKey(email string) *datastore.Key {
+	return datastore.NameKey(directoryEntryKind, email, nil)
+}
+
+func (s *datastoreDirectoryStore) Put(ctx context.Context, entry *directoryEntry) error {
+	key := directoryEntryKey(entry.Email)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var existing directoryEntry
+
+		if err := tx.Get(key, &existing); err == nil && existing.User != entry.User {
+			return errorEmailClaimed
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := tx.Put(key, entry)
+
+		return err
+	})
+
+	return err
+}
+
+func (s *datastoreDirectoryStore) Lookup(ctx context.Context, email string) (*directoryEntry, error) {
+	var entry directoryEntry
+
+	if err := s.c.Get(ctx, directoryEntryKey(email), &entry); err == datastore.ErrNoSuchEntity {
+		return nil, errorUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (s *datastoreDirectoryStore) Reassign(ctx context.Context, from string, to string) error {
+	var entries []*directoryEntry
+
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(directoryEntryKind).Filter("User =", from), &entries)
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entry.User = to
+	}
+
+	return datastoreBatches(len(keys), func(start int, end int) error {
+		_, err := s.c.PutMulti(ctx, keys[start:end], entries[start:end])
+
+		return err
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryDirectoryStore keeps the directory for the lifetime of the process
+type memoryDirectoryStore struct {
+	lock    sync.Mutex
+	entries map[string]directoryEntry
+}
+
+func newMemoryDirectoryStore() *memoryDirectoryStore {
+	return &memoryDirectoryStore{
+		entries: make(map[string]directoryEntry),
+	}
+}
+
+func (s *memoryDirectoryStore) Put(ctx context.Context, entry *directoryEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, found := s.entries[entry.Email]; found && existing.User != entry.User {
+		return errorEmailClaimed
+	}
+
+	s.entries[entry.Email] = *entry
+
+	return nil
+}
+
+func (s *memoryDirectoryStore) Lookup(ctx context.Context, email string) (*directoryEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, found := s.entries[email]
+
+	if !found {
+		return nil, errorUserNotFound
+	}
+
+	return &entry, nil
+}
+
+func (s *memoryDirectoryStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for email, entry := range s.entries {
+		if entry.User == from {
+			entry.User = to
+			s.entries[email] = entry
+		}
+	}
+
+	return nil
+}
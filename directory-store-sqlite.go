@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+type sqliteDirectoryStore struct {
+	db *sql.DB
+}
+
+func newSQLiteDirectoryStore(db *sql.DB) *sqliteDirectoryStore {
+	return &sqliteDirectoryStore{
+		db: db,
+	}
+}
+
+func (s *sqliteDirectoryStore) Put(ctx context.Context, entry *directoryEntry) error {
+	result, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO directory (email, user, updated) VALUES (?, ?, ?)",
+		entry.Email, entry.User, sqliteTime(entry.Updated))
+
+	if err != nil {
+		return err
+	}
+
+	if sqliteRequireUpdate(result) == nil {
+		return nil
+	}
+
+	// The email is already recorded, and only its own user may refresh it
+	result, err = s.db.ExecContext(ctx, "UPDATE directory SET updated = ? WHERE email = ? AND user = ?",
+		sqliteTime(entry.Updated), entry.Email, entry.User)
+
+	if err != nil {
+		return err
+	}
+
+	if err := sqliteRequireUpdate(result); err == errorTokenNotFound {
+		return errorEmailClaimed
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqliteDirectoryStore) Lookup(ctx context.Context, email string) (*directoryEntry, error) {
+	var entry directoryEntry
+
+	var updated int64
+
+	err := s.db.QueryRowContext(ctx, "SELECT email, user, updated FROM directory WHERE email = ?", email).Scan(&entry.Email, &entry.User, &updated)
+
+	if err == sql.ErrNoRows {
+		return nil, errorUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	entry.Updated = fromSQLiteTime(updated)
+
+	return &entry, nil
+}
+
+func (s *sqliteDirectoryStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE directory SET user = ? WHERE user = ?", to, from)
+
+	return err
+}
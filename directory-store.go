@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+const directoryEntryKind = "DirectoryEntry"
+
+var errorUserNotFound = errors.New("User not found")
+
+var errorEmailClaimed = errors.New("Email belongs to another user")
+
+// directoryEntry records the user who first signed in with an email, so that items can be shared with them by email
+type directoryEntry struct {
+	Email   string
+	User    string
+	Updated time.Time
+}
+
+// directoryEmail gives the form emails are looked up in, as they are not case sensitive in practice
+func directoryEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// DirectoryStore persists the users emails belong to, keyed by email
+type DirectoryStore interface {
+	// Put records the user an email belongs to, returning errorEmailClaimed if it already belongs to another user
+	Put(ctx context.Context, entry *directoryEntry) error
+	// Lookup finds the user of an email, returning errorUserNotFound if nobody has signed in with it
+	Lookup(ctx context.Context, email string) (*directoryEntry, error)
+	// Reassign moves every email of a user to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+}
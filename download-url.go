@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const downloadPath = "/download/"
+
+const defaultDownloadURLLifetime = time.Hour
+
+// maxDownloadURLLifetime is the longest a storage V4 signed URL may last
+const maxDownloadURLLifetime = 7 * 24 * time.Hour
+
+var errorInvalidDownloadURL = errors.New("Invalid download URL")
+
+var errorDownloadURLExpired = errors.New("Download URL expired")
+
+// downloadURLProbe is the object blobStoreSigns signs a URL for, which need not exist
+const downloadURLProbe = "download-url-probe"
+
+// blobStoreSigns checks whether the blob store signs download URLs itself, so that ours are only a fallback
+func blobStoreSigns(blobStore BlobStore) bool {
+	_, err := blobStore.SignedURL(downloadURLProbe, BlobURLOptions{
+		Expiry: time.Now().Add(time.Minute),
+	})
+
+	if err != nil && err != errorSignedURLUnsupported {
+		log.Println("Blob store cannot sign download URLs:", err)
+	}
+
+	return err == nil
+}
+
+// loadDownloadURLSecrets reads the comma separated secrets download URLs are signed with, newest first.
+// Older secrets are kept so that URLs signed before a rotation work until they expire.
+// An empty value is the same as none, so that deploy files can leave it to be filled in.
+func loadDownloadURLSecrets(blobStoreSigns bool) ([][]byte, error) {
+	secretsText, secretsDeclared := os.LookupEnv("DOWNLOAD_URL_SECRETS")
+
+	if !secretsDeclared || secretsText == "" {
+		// App Engine and Cloud Run run several instances, which would each sign with their own random secret
+		_, appEngine := os.LookupEnv("GAE_INSTANCE")
+		_, cloudRun := os.LookupEnv("K_SERVICE")
+
+		if (appEngine || cloudRun) && !blobStoreSigns {
+			return nil, errors.New("download URL secrets must be declared when running on several instances with a blob store which cannot sign URLs")
+		}
+
+		log.Println("Download URL secrets not declared, defaulting to a random secret which changes on restart")
+
+		secret := make([]byte, sha256.Size)
+
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			return nil, err
+		}
+
+		return [][]byte{secret}, nil
+	}
+
+	var secrets [][]byte
+
+	for _, secret := range strings.Split(secretsText, ",") {
+		secret = strings.TrimSpace(secret)
+
+		if secret == "" {
+			return nil, errors.New("empty download URL secret")
+		}
+
+		secrets = append(secrets, []byte(secret))
+	}
+
+	return secrets, nil
+}
+
+func loadDownloadURLLifetime() (time.Duration, error) {
+	lifetimeText, lifetimeDeclared := os.LookupEnv("DOWNLOAD_URL_LIFETIME")
+
+	if !lifetimeDeclared {
+		log.Println("Download URL lifetime not declared, defaulting to", defaultDownloadURLLifetime)
+		return defaultDownloadURLLifetime, nil
+	}
+
+	lifetime, err := time.ParseDuration(lifetimeText)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if lifetime <= 0 || lifetime > maxDownloadURLLifetime {
+		return 0, errors.New("download URL lifetime must be positive and at most a week")
+	}
+
+	return lifetime, nil
+}
+
+// DownloadURLs signs URLs items can be downloaded from without signing in, until they expire
+type DownloadURLs struct {
+	secrets   [][]byte
+	lifetime  time.Duration
+	blobStore BlobStore
+}
+
+func newDownloadURLs(secrets [][]byte, lifetime time.Duration, blobStore BlobStore) *DownloadURLs {
+	return &DownloadURLs{
+		secrets:   secrets,
+		lifetime:  lifetime,
+		blobStore: blobStore,
+	}
+}
+
+func signDownload(secret []byte, object string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(object + "\n" + expires))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign gives a URL an item can be downloaded from, signed by the blob store where it serves blobs itself.
+// The URL expires after the configured lifetime, or with the item if that is sooner.
+// If the blob store fails to sign, the item is served from our own URL instead, as items are already stored by then.
+func (d *DownloadURLs) Sign(item *clipItem, now time.Time) string {
+	expiry := now.Add(d.lifetime)
+
+	if !item.Expiry.IsZero() && item.Expiry.Before(expiry) {
+		expiry = item.Expiry
+	}
+
+	signedURL, err := d.blobStore.SignedURL(item.Object, BlobURLOptions{
+		Expiry:             expiry,
+		ContentType:        itemContentType(item),
+		ContentDisposition: contentDisposition(item.Name),
+	})
+
+	if err == nil {
+		return signedURL
+	} else if err != errorSignedURLUnsupported {
+		log.Println("Error signing download URL, serving it ourselves instead:", err)
+	}
+
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+
+	return downloadPath + item.Object + "?" + url.Values{
+		"expires":   {expires},
+		"signature": {signDownload(d.secrets[0], item.Object, expires)},
+	}.Encode()
+}
+
+// verify checks that a download URL was signed for an object with any of the secrets, and has not expired
+func (d *DownloadURLs) verify(object string, query url.Values, now time.Time) error {
+	expires := query.Get("expires")
+
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+
+	if err != nil {
+		return errorInvalidDownloadURL
+	}
+
+	signature := []byte(query.Get("signature"))
+
+	for _, secret := range d.secrets {
+		if hmac.Equal(signature, []byte(signDownload(secret, object, expires))) {
+			if now.After(time.Unix(expiresUnix, 0)) {
+				return errorDownloadURLExpired
+			}
+
+			return nil
+		}
+	}
+
+	return errorInvalidDownloadURL
+}
+
+type downloadHandler struct {
+	downloadURLs *DownloadURLs
+}
+
+func (h *downloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	object := strings.TrimPrefix(r.URL.Path, downloadPath)
+
+	if err := h.downloadURLs.verify(object, r.URL.Query(), time.Now()); err != nil {
+		log.Println("Invalid download URL:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	// Signatures only cover object names the app made, but the name is checked before it reaches the blob store anyway
+	if _, id := splitObjectName(object); checkItemID(id) != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	serveItemContent(w, r, h.downloadURLs.blobStore, object)
+}
+
+// DownloadHandler serves items from the URLs signed by downloadURLs, without a session
+func DownloadHandler(downloadURLs *DownloadURLs) (string, http.Handler) {
+	return downloadPath, &downloadHandler{
+		downloadURLs: downloadURLs,
+	}
+}
@@ -1,41 +1,36 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
-
-	oldContext "golang.org/x/net/context"
-
-	"google.golang.org/api/iterator"
-
-	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
+	"time"
 )
 
 const eventsPath = "/events"
 
 type eventsHandler struct {
-	ctx               context.Context
-	googleLoginAppID  string
-	pubsubClient      *pubsub.Client
-	storageBucketName string
-	storageBucket     *storage.BucketHandle
-	datastoreClient   *datastore.Client
-}
-
-type googleIdentity struct {
-	Aud   string
-	Email string
-	Sub   string
+	ctx              context.Context
+	providers        OIDCProviders
+	accessPolicy     *AccessPolicy
+	notificationBus  NotificationBus
+	blobStore        BlobStore
+	sessionStore     SessionStore
+	accessTokenStore AccessTokenStore
+	itemStore        ItemStore
+	shareStore       ShareStore
+	directoryStore   DirectoryStore
+	userIDs          *UserIDs
+	downloadURLs     *DownloadURLs
+	// replayItems is how many of the newest items are sent when a stream connects
+	replayItems int
 }
 
 func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -61,48 +56,68 @@ func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		identityToken := r.URL.Query().Get("token")
+		var auth *requestAuth
 
-		identityResp, err := http.Get("https://www.googleapis.com/oauth2/v3/tokeninfo?id_token=" + identityToken)
+		if identityToken := r.URL.Query().Get("token"); identityToken != "" {
+			provider, userID, userEmail, err := h.providers.VerifyToken(identityToken)
 
-		if err != nil {
-			log.Println("Failed to authenticate token:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
+			if err != nil {
+				log.Println("Invalid token:", err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 
-		if identityResp.StatusCode != http.StatusOK {
-			log.Println("Invalid token")
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-			return
-		}
+			userKey := provider.UserKey(userID)
+
+			if err := h.accessPolicy.Check(userEmail, userKey); err != nil {
+				log.Println("Refused user", userID, "of", provider.Name+":", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 
-		defer identityResp.Body.Close()
+			userIDHash, err := h.userIDs.Resolve(ctx, userKey)
 
-		identityRespDecoder := json.NewDecoder(identityResp.Body)
+			if err != nil {
+				log.Println("Failed to resolve user ID:", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
 
-		var userIdentity googleIdentity
+			if err := recordDirectoryEntry(ctx, h.directoryStore, userEmail, userIDHash); err != nil {
+				log.Println("Error recording user email:", err)
+			}
 
-		if err := identityRespDecoder.Decode(&userIdentity); err != nil {
-			log.Println("Failed to parse identity:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
+			session, err := genToken(ctx, h.sessionStore, userIDHash, userKey, userEmail, requestDevice(r))
 
-		if userIdentity.Aud != h.googleLoginAppID {
-			log.Println("Invalid audience:", userIdentity.Aud)
-			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-			return
-		}
+			if err != nil {
+				log.Println("Failed to generate token:", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			auth = sessionAuth(session)
+
+			log.Println("User", userID, "of", provider.Name, "logged in as", userIDHash)
+		} else {
+			// Reconnecting with the session from an earlier login or with an access token, either of which is checked against the access policy again
+			var err error
+
+			auth, err = authenticateRequest(ctx, h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeRead)
+
+			if err != nil {
+				log.Println("Invalid session:", err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
 
-		userID := userIdentity.Sub
-		userEmail := userIdentity.Email
+			log.Println("User", auth.User, "reconnected")
+		}
 
-		userIDHashBytes := sha256.Sum256([]byte(fmt.Sprint(userID)))
+		userIDHash := auth.User
 
-		userIDHash := base64.RawURLEncoding.EncodeToString(userIDHashBytes[:])
+		session := auth.Session
 
-		subscription, err := createSubscription(ctx, h.pubsubClient, userIDHash)
+		subscription, err := h.notificationBus.Subscribe(ctx, userIDHash)
 
 		if err != nil {
 			log.Println("Failed to generate subscription:", err)
@@ -110,12 +125,11 @@ func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		sessionToken, err := genToken(ctx, h.datastoreClient, userIDHash, userEmail)
+		csrfToken := ""
 
-		if err != nil {
-			log.Println("Failed to generate token:", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+		if session != nil {
+			setSessionCookie(w, session)
+			csrfToken = session.CSRFToken
 		}
 
 		w.Header().Set("Content-Type", "text/event-stream")
@@ -125,47 +139,79 @@ func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.WriteHeader(http.StatusOK)
 
-		fmt.Fprintf(w, "data: %s\n\n", sessionToken)
+		// Clients using access tokens have no use for a CSRF token, but still receive an empty first message
+		fmt.Fprintf(w, "data: %s\n\n", csrfToken)
 
 		f.Flush()
 
-		log.Println("User", userID, "logged in")
-
-		defer func() { log.Println("User", userID, "disconnected") }()
-
-		objIter := h.storageBucket.Objects(ctx, &storage.Query{Prefix: userIDHash})
+		defer func() { log.Println("User", userIDHash, "disconnected") }()
+
+		// An open stream keeps its session alive, and ends once the session is revoked, reaches its maximum lifetime or is refused by the access policy
+		if session != nil {
+			go func() {
+				ticker := time.NewTicker(tokenTimeout / 2)
+				defer ticker.Stop()
+
+				end := time.NewTimer(time.Until(sessionEnd(session)))
+				defer end.Stop()
+
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-end.C:
+						closeFunc()
+						return
+					case <-ticker.C:
+						if err := checkSessionPolicy(ctx, h.accessPolicy, h.sessionStore, session); err != nil {
+							log.Println("Refused session of user", session.User+":", err)
+							closeFunc()
+							return
+						}
+
+						if err := refreshSession(ctx, h.sessionStore, session); err == errorTokenNotFound {
+							closeFunc()
+							return
+						} else if err != nil {
+							log.Println("Error refreshing session:", err)
+						}
+					}
+				}
+			}()
+		}
 
-		for {
-			objAttrs, err := objIter.Next()
+		// Older items are fetched from the items API as the client needs them
+		var history []*listedItem
 
-			if err == iterator.Done {
-				break
-			}
+		if h.replayItems > 0 {
+			history, err = listItems(ctx, h.itemStore, h.shareStore, userIDHash, itemQuery{
+				Limit: h.replayItems,
+			})
 
 			if err != nil {
-				log.Println("Error fetching object from history:", err)
+				log.Println("Error fetching history:", err)
 				return
 			}
+		}
 
-			bodyBuffer := new(bytes.Buffer)
-
-			if objAttrs.ContentType == clipboardMimeType {
-				obj := h.storageBucket.Object(objAttrs.Name)
+		now := time.Now()
 
-				objReader, err := obj.NewReader(ctx)
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].expired(now) {
+				continue
+			}
 
-				if err != nil {
-					log.Println("Error getting object reader:", err)
-					return
-				}
+			notification, err := readFileNotification(ctx, h.blobStore, h.downloadURLs, history[i])
 
-				if _, err := io.Copy(bodyBuffer, objReader); err != nil {
-					log.Println("Error reading object data from history:", err)
-					return
-				}
+			if err == errorBlobNotFound {
+				// Deleted since the listing was taken
+				continue
+			} else if err != nil {
+				log.Println("Error reading object data from history:", err)
+				return
 			}
 
-			notificationData, err := json.Marshal(createFileNotification(h.storageBucketName, objAttrs, bodyBuffer))
+			notificationData, err := json.Marshal(notification)
 
 			if err != nil {
 				log.Println("Error marshalling notification:", err)
@@ -178,12 +224,21 @@ func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		eventStreamLock := &sync.Mutex{}
 
-		if err := subscription.Receive(ctx, func(ctx oldContext.Context, m *pubsub.Message) {
+		if err := subscription.Receive(ctx, func(data []byte) {
+			var revoked sessionRevokedNotification
+
+			if json.Unmarshal(data, &revoked) == nil && revoked.Event == sessionRevokedEvent {
+				if revoked.Session == auth.ID {
+					closeFunc()
+				}
+
+				return
+			}
+
 			eventStreamLock.Lock()
 			defer eventStreamLock.Unlock()
-			defer m.Ack()
 
-			fmt.Fprintf(w, "data: %s\n\n", base64.StdEncoding.EncodeToString(m.Data))
+			fmt.Fprintf(w, "data: %s\n\n", base64.StdEncoding.EncodeToString(data))
 			f.Flush()
 		}); err != nil {
 			log.Println("Error receiving messages:", err)
@@ -194,14 +249,46 @@ func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// defaultReplayItems is how many items a stream replays if HISTORY_REPLAY_ITEMS is not declared
+const defaultReplayItems = 50
+
+// loadReplayItems reads how many of the newest items a stream replays on connecting, where 0 replays none
+func loadReplayItems() (int, error) {
+	replayText, replayDeclared := os.LookupEnv("HISTORY_REPLAY_ITEMS")
+
+	if !replayDeclared {
+		log.Println("History replay not declared, defaulting to", defaultReplayItems, "items")
+		return defaultReplayItems, nil
+	}
+
+	replayItems, err := strconv.Atoi(replayText)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if replayItems < 0 {
+		return 0, errors.New("negative history replay")
+	}
+
+	return replayItems, nil
+}
+
 //EventsHandler handles notifying clients of events
-func EventsHandler(ctx context.Context, googleLoginAppID string, pubsubClient *pubsub.Client, storageBucketName string, storageBucket *storage.BucketHandle, datastoreClient *datastore.Client) (string, http.Handler) {
+func EventsHandler(ctx context.Context, providers OIDCProviders, accessPolicy *AccessPolicy, notificationBus NotificationBus, blobStore BlobStore, sessionStore SessionStore, accessTokenStore AccessTokenStore, itemStore ItemStore, shareStore ShareStore, directoryStore DirectoryStore, userIDs *UserIDs, downloadURLs *DownloadURLs, replayItems int) (string, http.Handler) {
 	return eventsPath, &eventsHandler{
-		ctx:               ctx,
-		googleLoginAppID:  googleLoginAppID,
-		pubsubClient:      pubsubClient,
-		storageBucketName: storageBucketName,
-		storageBucket:     storageBucket,
-		datastoreClient:   datastoreClient,
+		ctx:              ctx,
+		providers:        providers,
+		accessPolicy:     accessPolicy,
+		notificationBus:  notificationBus,
+		blobStore:        blobStore,
+		sessionStore:     sessionStore,
+		accessTokenStore: accessTokenStore,
+		itemStore:        itemStore,
+		shareStore:       shareStore,
+		directoryStore:   directoryStore,
+		userIDs:          userIDs,
+		downloadURLs:     downloadURLs,
+		replayItems:      replayItems,
 	}
 }
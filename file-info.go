@@ -2,31 +2,115 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-
-	"cloud.google.com/go/storage"
+	"context"
+	"io"
+	"time"
 )
 
-const storageURL = "https://storage.cloud.google.com"
-
 const clipboardMimeType = "text/x-clipboard"
 
 const metaDataName = "x-name"
 
+const metaDataExpiry = "x-expiry"
+
+// fileNotification describes a clipboard item, and is published without an Event when the item is created
 type fileNotification struct {
+	ID      string
 	Name    string
 	Type    string
 	Created int64
 	URL     string
 	Body    string
+	// Expiry is when the item will be deleted in milliseconds, or 0 if it has no expiry
+	Expiry int64
+	// SharedBy is the email of the user who shared the item, or empty for the user's own items
+	SharedBy string
+}
+
+// previewText cuts text down to the preview size, without splitting a character
+func previewText(text string) string {
+	return truncateText(text, maxPreviewSize)
+}
+
+// newClipItem indexes a stored blob, with the body of clipboard text
+func newClipItem(attrs *BlobAttrs, body string) *clipItem {
+	user, id := splitObjectName(attrs.Name)
+
+	// Blobs without a valid expiry are kept until their user's retention settings remove them
+	expiry, _ := time.Parse(time.RFC3339, attrs.Metadata[metaDataExpiry])
+
+	return &clipItem{
+		User:    user,
+		ID:      id,
+		Name:    attrs.Metadata[metaDataName],
+		Type:    attrs.ContentType,
+		Size:    attrs.Size,
+		Created: attrs.Created,
+		Object:  attrs.Name,
+		Preview: previewText(body),
+		Expiry:  expiry,
+	}
+}
+
+// createFileNotification describes an item, with a URL it can be downloaded from without signing in
+func createFileNotification(item *clipItem, body string, downloadURL string) *fileNotification {
+	notification := &fileNotification{
+		ID:      item.ID,
+		Name:    item.Name,
+		Type:    item.Type,
+		Created: item.Created.UTC().UnixNano() / 1000000,
+		URL:     downloadURL,
+		Body:    body,
+	}
+
+	if !item.Expiry.IsZero() {
+		notification.Expiry = item.Expiry.UTC().UnixNano() / 1000000
+	}
+
+	return notification
+}
+
+// readFileNotification describes an item in a user's history, reading the body of clipboard text if the preview does not hold all of it
+func readFileNotification(ctx context.Context, blobStore BlobStore, downloadURLs *DownloadURLs, listed *listedItem) (*fileNotification, error) {
+	item := listed.clipItem
+
+	downloadURL := downloadURLs.Sign(item, time.Now())
+
+	body := item.Preview
+
+	if item.Type == clipboardMimeType && int64(len(item.Preview)) != item.Size {
+		var err error
+
+		body, err = readBlobText(ctx, blobStore, item.Object)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notification := createFileNotification(item, body, downloadURL)
+
+	if listed.share != nil {
+		notification.SharedBy = listed.share.OwnerEmail
+	}
+
+	return notification, nil
 }
 
-func createFileNotification(bucketName string, objAttrs *storage.ObjectAttrs, body *bytes.Buffer) *fileNotification {
-	return &fileNotification{
-		Name:    objAttrs.Metadata[metaDataName],
-		Type:    objAttrs.ContentType,
-		Created: objAttrs.Created.UTC().UnixNano() / 1000000,
-		URL:     fmt.Sprintf("%s/%s/%s", storageURL, bucketName, objAttrs.Name),
-		Body:    string(body.Bytes()),
+func readBlobText(ctx context.Context, blobStore BlobStore, name string) (string, error) {
+	objReader, err := blobStore.NewReader(ctx, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer objReader.Close()
+
+	bodyBuffer := new(bytes.Buffer)
+
+	if _, err := io.Copy(bodyBuffer, objReader); err != nil {
+		return "", err
 	}
+
+	return bodyBuffer.String(), nil
 }
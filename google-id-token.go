@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
-	"crypto/sha256"
+	_ "crypto/sha256" // Registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // Registers SHA-384 and SHA-512 for crypto.Hash
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"math/big"
 	"strings"
 	"time"
 )
@@ -16,21 +19,85 @@ type tokenHeader struct {
 	Kid string
 }
 
+// audience is the aud claim, which may be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+
+	*a = audience(multiple)
+	return nil
+}
+
+// claimBool is a boolean claim, which some providers encode as a string
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var value bool
+
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = claimBool(value)
+		return nil
+	}
+
+	var text string
+
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+
+	*b = claimBool(text == "true")
+	return nil
+}
+
+// TokenRequirements describes who must have issued a token and who it must be for
+type TokenRequirements struct {
+	Issuers   []string
+	Audiences []string
+	// ClockSkew is the leeway allowed when checking the token's timestamps
+	ClockSkew time.Duration
+	// HostedDomain restricts Google tokens to accounts of a Google Workspace domain, if set
+	HostedDomain string
+}
+
 type tokenBody struct {
-	Aud   string
-	Email string
-	Exp   int64
-	IAt   int64
-	Iss   string
-	Sub   string
+	Aud           audience
+	Azp           string
+	Email         string
+	EmailVerified *claimBool `json:"email_verified"`
+	Exp           int64
+	Hd            string
+	IAt           int64
+	Iss           string
+	Nbf           int64
+	Sub           string
 }
 
-// VerifyToken verified the given token with the given public keys and app unique id
-func VerifyToken(token string, keys []Key, aud string) (id string, email string, err error) {
-	sections := strings.Split(token, ".")
+func splitToken(token string) (sections []string, err error) {
+	sections = strings.Split(token, ".")
 
 	if len(sections) != 3 {
 		err = errors.New("token does not contain header, body, and signiature")
+	}
+
+	return
+}
+
+func parseTokenHeader(token string) (header tokenHeader, err error) {
+	sections, err := splitToken(token)
+
+	if err != nil {
 		return
 	}
 
@@ -40,76 +107,177 @@ func VerifyToken(token string, keys []Key, aud string) (id string, email string,
 		return
 	}
 
-	var header tokenHeader
-
 	err = json.Unmarshal(hBytes, &header)
+	return
+}
+
+// parseUnverifiedTokenBody decodes a token's claims without checking its signature
+func parseUnverifiedTokenBody(token string) (body tokenBody, err error) {
+	sections, err := splitToken(token)
 
 	if err != nil {
 		return
 	}
 
-	key, err := LookupRSAKey(keys, header.Kid, header.Alg, "sig")
+	bBytes, err := base64.RawURLEncoding.DecodeString(sections[1])
 
 	if err != nil {
 		return
 	}
 
-	sBytes, err := base64.RawURLEncoding.DecodeString(sections[2])
+	err = json.Unmarshal(bBytes, &body)
+	return
+}
 
-	if err != nil {
-		return
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
 
-	switch header.Alg {
-	case "RS256":
-		hashed := sha256.Sum256([]byte(sections[0] + "." + sections[1]))
+	return false
+}
+
+func verifySignature(algorithm string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, found := algorithmHashes[algorithm]
+
+	if !found {
+		return errors.New("algorithm not supported")
+	}
+
+	hasher := hash.New()
+	hasher.Write(signed)
+	hashed := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(algorithm, "PS") {
+			return rsa.VerifyPSS(key, hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+
+		return rsa.VerifyPKCS1v15(key, hash, hashed, signature)
+	case *ecdsa.PublicKey:
+		// JWS encodes ECDSA signatures as the fixed width concatenation of r and s
+		size := (key.Curve.Params().BitSize + 7) / 8
 
-		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sBytes)
-		if err != nil {
-			return
+		if len(signature) != 2*size {
+			return errors.New("signature has wrong length")
 		}
+
+		var r, s big.Int
+
+		r.SetBytes(signature[:size])
+		s.SetBytes(signature[size:])
+
+		if !ecdsa.Verify(key, hashed, &r, &s) {
+			return errors.New("signature invalid")
+		}
+
+		return nil
 	default:
-		err = errors.New("algorithm not supported")
+		return errors.New("key type not supported")
+	}
+}
+
+// VerifyToken verified the given token with the given public keys and requirements.
+// The email is only given if the token says it was verified, as others may be claimed by anyone.
+func VerifyToken(token string, keys []Key, requirements TokenRequirements) (id string, email string, err error) {
+	sections, err := splitToken(token)
+
+	if err != nil {
 		return
 	}
 
-	bBytes, err := base64.RawURLEncoding.DecodeString(sections[1])
+	header, err := parseTokenHeader(token)
 
 	if err != nil {
 		return
 	}
 
-	var body tokenBody
+	key, err := LookupKey(keys, header.Kid, header.Alg, "sig")
 
-	err = json.Unmarshal(bBytes, &body)
+	if err != nil {
+		return
+	}
+
+	sBytes, err := base64.RawURLEncoding.DecodeString(sections[2])
+
+	if err != nil {
+		return
+	}
+
+	err = verifySignature(header.Alg, key, []byte(sections[0]+"."+sections[1]), sBytes)
 
 	if err != nil {
 		return
 	}
 
-	if body.Aud != aud {
+	body, err := parseUnverifiedTokenBody(token)
+
+	if err != nil {
+		return
+	}
+
+	audienceFound := false
+
+	for _, aud := range body.Aud {
+		audienceFound = audienceFound || containsString(requirements.Audiences, aud)
+	}
+
+	if !audienceFound {
 		err = errors.New("aud wrong")
 		return
 	}
 
-	if body.Iss != "accounts.google.com" && body.Iss != "https://accounts.google.com" {
+	// The authorized party must be one of our clients if the token is shared with others
+	if len(body.Aud) > 1 && body.Azp == "" {
+		err = errors.New("azp missing")
+		return
+	}
+
+	if body.Azp != "" && !containsString(requirements.Audiences, body.Azp) {
+		err = errors.New("azp wrong")
+		return
+	}
+
+	if !containsString(requirements.Issuers, body.Iss) {
 		err = errors.New("iss wrong")
 		return
 	}
 
-	if time.Now().Before(time.Unix(body.IAt, 0)) {
-		err = errors.New("issued in the past")
+	now := time.Now()
+
+	if now.Add(requirements.ClockSkew).Before(time.Unix(body.IAt, 0)) {
+		err = errors.New("issued in the future")
+		return
+	}
+
+	if body.Nbf != 0 && now.Add(requirements.ClockSkew).Before(time.Unix(body.Nbf, 0)) {
+		err = errors.New("not yet valid")
 		return
 	}
 
-	if time.Now().After(time.Unix(body.Exp, 0)) {
+	if now.Add(-requirements.ClockSkew).After(time.Unix(body.Exp, 0)) {
 		err = errors.New("expired")
 		return
 	}
 
+	if body.EmailVerified != nil && !bool(*body.EmailVerified) {
+		err = errors.New("email not verified")
+		return
+	}
+
+	if requirements.HostedDomain != "" && body.Hd != requirements.HostedDomain {
+		err = errors.New("hd wrong")
+		return
+	}
+
 	id = body.Sub
 
-	email = body.Email
+	if body.EmailVerified != nil && bool(*body.EmailVerified) {
+		email = body.Email
+	}
 
 	return
 }
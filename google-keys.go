@@ -1,31 +1,94 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const defaultGoogleKeysURL = "https://www.googleapis.com/oauth2/v3/certs"
+
 // Key is a JWK key
 type Key struct {
 	Kty string
 	Alg string
 	Use string
 	Kid string
-	N   string
-	E   string
+	// RSA parameters
+	N string
+	E string
+	// Elliptic curve parameters
+	Crv string
+	X   string
+	Y   string
+}
+
+// algorithmHashes maps the supported JWS algorithms to their digests
+var algorithmHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// algorithmCurves maps the ECDSA JWS algorithms to the curves they are defined over
+var algorithmCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
 }
 
 type jwkKeys struct {
 	Keys []Key
 }
 
-// GoogleKeys loads the Google Keys
-func GoogleKeys() (keys []Key, err error) {
-	r, err := http.Get("https://www.googleapis.com/oauth2/v3/certs")
+// cacheMaxAge finds the max-age directive of a Cache-Control header
+func cacheMaxAge(cacheControl string) (maxAge time.Duration, found bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+
+		if !strings.HasPrefix(strings.ToLower(directive), "max-age=") {
+			continue
+		}
+
+		seconds, err := strconv.ParseInt(directive[len("max-age="):], 10, 64)
+
+		if err != nil || seconds < 0 {
+			return 0, false
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// oidcFetchTimeout bounds fetching keys and discovery documents, so a hung server cannot block logins or startup
+const oidcFetchTimeout = 10 * time.Second
+
+var oidcHTTPClient = &http.Client{
+	Timeout: oidcFetchTimeout,
+}
+
+// FetchKeys loads a JWK set, along with how long it may be cached for
+func FetchKeys(url string) (keys []Key, maxAge time.Duration, maxAgeFound bool, err error) {
+	r, err := oidcHTTPClient.Get(url)
 
 	if err != nil {
 		return
@@ -33,6 +96,11 @@ func GoogleKeys() (keys []Key, err error) {
 
 	defer r.Body.Close()
 
+	if r.StatusCode != http.StatusOK {
+		err = fmt.Errorf("fetching keys: %s", r.Status)
+		return
+	}
+
 	var rawKeys jwkKeys
 
 	decoder := json.NewDecoder(r.Body)
@@ -44,35 +112,114 @@ func GoogleKeys() (keys []Key, err error) {
 	}
 
 	keys = rawKeys.Keys
+	maxAge, maxAgeFound = cacheMaxAge(r.Header.Get("Cache-Control"))
 	return
 }
 
-// LookupRSAKey searches through a list and finds an RSA key with the correct id, algorithm, and string
-func LookupRSAKey(keys []Key, id string, algorithm string, use string) (*rsa.PublicKey, error) {
-	for _, key := range keys {
-		if key.Kty == "RSA" && key.Alg == algorithm && key.Use == use {
-			nBytes, err := base64.RawURLEncoding.DecodeString(key.N)
+// GoogleKeys loads the Google Keys
+func GoogleKeys() (keys []Key, err error) {
+	keys, _, _, err = FetchKeys(defaultGoogleKeysURL)
+	return
+}
 
-			if err != nil {
-				return nil, err
-			}
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
 
-			eBytes, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	var i big.Int
 
-			var n, e big.Int
+	i.SetBytes(bytes)
 
-			n.SetBytes(nBytes)
-			e.SetBytes(eBytes)
+	return &i, nil
+}
+
+func rsaPublicKey(key Key) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(key.N)
 
-			return &rsa.PublicKey{
-				N: &n,
-				E: int(e.Int64())}, nil
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := decodeBigInt(key.E)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: n,
+		E: int(e.Int64())}, nil
+}
+
+func ecdsaPublicKey(key Key) (*ecdsa.PublicKey, error) {
+	curve, found := curves[key.Crv]
+
+	if !found {
+		return nil, errors.New("curve not supported")
+	}
+
+	x, err := decodeBigInt(key.X)
+
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := decodeBigInt(key.Y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point not on curve")
+	}
+
+	return &ecdsa.PublicKey{
+		Curve: curve,
+		X:     x,
+		Y:     y}, nil
+}
+
+// LookupKey searches through a list and finds a key with the correct id, algorithm, and use.
+// Keys which do not declare an algorithm or use match any.
+func LookupKey(keys []Key, id string, algorithm string, use string) (crypto.PublicKey, error) {
+	if _, found := algorithmHashes[algorithm]; !found {
+		return nil, errors.New("algorithm not supported")
+	}
+
+	for _, key := range keys {
+		if key.Kid != id || (key.Alg != "" && key.Alg != algorithm) || (key.Use != "" && key.Use != use) {
+			continue
+		}
+
+		if curve, isECDSA := algorithmCurves[algorithm]; isECDSA {
+			if key.Kty == "EC" && key.Crv == curve {
+				return ecdsaPublicKey(key)
+			}
+		} else if key.Kty == "RSA" {
+			return rsaPublicKey(key)
 		}
 	}
 
 	return nil, errors.New("Key not found")
 }
+
+// LookupRSAKey searches through a list and finds an RSA key with the correct id, algorithm, and use
+func LookupRSAKey(keys []Key, id string, algorithm string, use string) (*rsa.PublicKey, error) {
+	key, err := LookupKey(keys, id, algorithm, use)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, isRSA := key.(*rsa.PublicKey)
+
+	if !isRSA {
+		return nil, errors.New("Key not found")
+	}
+
+	return rsaKey, nil
+}
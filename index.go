@@ -6,10 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-
-	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
+	"strconv"
 )
 
 func main() {
@@ -20,45 +17,129 @@ func main() {
 	projectID, projectIDDeclared := os.LookupEnv("PROJECT_ID")
 
 	if !projectIDDeclared {
-		log.Println("Project ID not declared")
+		log.Println("Project ID not declared, Google Cloud backends are unavailable")
+	}
+
+	log.Println("Loading identity providers")
+	providers, err := loadOIDCProviders()
+	if err != nil {
+		log.Println("Error loading identity providers:", err)
+		return
+	}
+
+	var accessPolicy *AccessPolicy
+
+	if accessPolicyPath, accessPolicyPathDeclared := os.LookupEnv("ACCESS_POLICY_FILE"); accessPolicyPathDeclared {
+		log.Println("Loading access policy", accessPolicyPath)
+		accessPolicy, err = LoadAccessPolicy(ctx, accessPolicyPath)
+		if err != nil {
+			log.Println("Error loading access policy:", err)
+			return
+		}
+	} else {
+		log.Println("Access policy not declared, allowing all users")
+	}
+
+	userIDSecrets, err := loadUserIDSecrets()
+	if err != nil {
+		log.Println("Error loading user ID secrets:", err)
+		return
+	}
+
+	webAuthn, err := loadWebAuthn()
+	if err != nil {
+		log.Println("Error configuring WebAuthn:", err)
+		return
+	}
+
+	localAccounts := false
+
+	registrationOpen := false
+
+	if localAccountsText, localAccountsDeclared := os.LookupEnv("LOCAL_ACCOUNTS"); localAccountsDeclared {
+		localAccounts, err = strconv.ParseBool(localAccountsText)
+		if err != nil {
+			log.Println("Error parsing local accounts setting:", err)
+			return
+		}
+	} else {
+		log.Println("Local accounts not declared, local accounts are disabled")
+	}
+
+	if localAccounts {
+		registrationOpen, err = loadRegistrationOpen()
+		if err != nil {
+			log.Println("Error parsing local registration setting:", err)
+			return
+		}
+	}
+
+	replayItems, err := loadReplayItems()
+	if err != nil {
+		log.Println("Error parsing history replay setting:", err)
 		return
 	}
 
-	googleLoginAppID, googleLoginAppIDDeclared := os.LookupEnv("GOOGLE_SIGN_IN_APP_ID")
+	quotaDefaults, err := loadQuotaDefaults()
+	if err != nil {
+		log.Println("Error parsing quota settings:", err)
+		return
+	}
 
-	if !googleLoginAppIDDeclared {
-		log.Println("Google Login App ID not declared")
+	trustedProxies, err := loadTrustedProxies()
+	if err != nil {
+		log.Println("Error parsing trusted proxies:", err)
 		return
 	}
 
-	storageBucketName, storageBucketNameDeclared := os.LookupEnv("STORAGE_BUCKET")
+	cronToken := loadCronToken()
 
-	if !storageBucketNameDeclared {
-		log.Println("Storage Bucket not declared")
+	downloadURLLifetime, err := loadDownloadURLLifetime()
+	if err != nil {
+		log.Println("Error parsing download URL lifetime:", err)
 		return
 	}
 
-	log.Println("Connecting to PubSub")
-	pubsubClient, err := pubsub.NewClient(ctx, projectID)
+	log.Println("Opening notification bus")
+	notificationBus, err := openNotificationBus(ctx, projectID)
 	if err != nil {
-		log.Println("Error Connecting to PubSub:", err)
+		log.Println("Error opening notification bus:", err)
 		return
 	}
 
-	log.Println("Connecting to FileStore")
-	storageClient, err := storage.NewClient(ctx)
+	log.Println("Opening blob store")
+	blobStore, err := openBlobStore(ctx, projectID)
 	if err != nil {
-		log.Println("Error connecting to FileStore:", err)
+		log.Println("Error opening blob store:", err)
 		return
 	}
 
-	log.Println("Creating bucket")
-	storageBucket := storageClient.Bucket(storageBucketName)
+	downloadURLSecrets, err := loadDownloadURLSecrets(blobStoreSigns(blobStore))
+	if err != nil {
+		log.Println("Error loading download URL secrets:", err)
+		return
+	}
 
-	log.Println("Connecting to DataStore")
-	datastoreClient, err := datastore.NewClient(ctx, projectID)
+	log.Println("Opening stores")
+	stores, err := openStores(ctx, projectID)
 	if err != nil {
-		log.Println("Error connecting to DataStore:", err)
+		log.Println("Error opening stores:", err)
+		return
+	}
+
+	sessionStore := stores.Sessions
+
+	userIDs := newUserIDs(userIDSecrets, blobStore, stores)
+
+	downloadURLs := newDownloadURLs(downloadURLSecrets, downloadURLLifetime, blobStore)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1:], notificationBus, blobStore, stores); err != nil {
+			log.Println("Error running", os.Args[1]+":", err)
+			os.Exit(1)
+		}
+
+		return
 	}
 
 	port, portDeclared := os.LookupEnv("PORT")
@@ -74,9 +155,44 @@ func main() {
 
 	mux := http.NewServeMux()
 
-	mux.Handle(EventsHandler(ctx, googleLoginAppID, pubsubClient, storageBucketName, storageBucket, datastoreClient))
-	mux.Handle(UploadHandler(projectID, googleLoginAppID, pubsubClient, storageBucketName, storageBucket, datastoreClient))
-	mux.Handle(CleanCookiesHandler(datastoreClient))
+	mux.Handle(EventsHandler(ctx, providers, accessPolicy, notificationBus, blobStore, sessionStore, stores.AccessTokens, stores.Items, stores.Shares, stores.Directory, userIDs, downloadURLs, replayItems))
+	mux.Handle(UploadHandler(notificationBus, blobStore, accessPolicy, sessionStore, stores.AccessTokens, stores.Items, stores.Usage, quotaDefaults, downloadURLs))
+	mux.Handle(UsageHandler(quotaDefaults, accessPolicy, sessionStore, stores.AccessTokens, stores.Usage))
+
+	itemsPath, itemsHandler := ItemsHandler(notificationBus, blobStore, accessPolicy, sessionStore, stores.AccessTokens, stores.Items, stores.Usage, stores.Shares, stores.Directory, downloadURLs)
+	mux.Handle(itemsPath, itemsHandler)
+	mux.Handle(itemsPath+"/", itemsHandler)
+
+	mux.Handle(DownloadHandler(downloadURLs))
+
+	mux.Handle(SessionRefreshHandler(accessPolicy, sessionStore))
+	mux.Handle(LogoutHandler(accessPolicy, sessionStore, notificationBus))
+
+	sessionsPath, sessionsHandler := SessionsHandler(accessPolicy, sessionStore, notificationBus)
+	mux.Handle(sessionsPath, sessionsHandler)
+	mux.Handle(sessionsPath+"/", sessionsHandler)
+
+	accessTokensPath, accessTokensHandler := AccessTokensHandler(accessPolicy, sessionStore, stores.AccessTokens, notificationBus)
+	mux.Handle(accessTokensPath, accessTokensHandler)
+	mux.Handle(accessTokensPath+"/", accessTokensHandler)
+
+	pairPath, pairHandler := PairHandler(accessPolicy, sessionStore, stores.Pairings, trustedProxies)
+	mux.Handle(pairPath, pairHandler)
+	mux.Handle(pairPath+"/", pairHandler)
+
+	if localAccounts {
+		mux.Handle(AccountsHandler(registrationOpen, accessPolicy, notificationBus, sessionStore, stores.Accounts, userIDs, trustedProxies))
+	}
+
+	if webAuthn != nil {
+		passkeysPath, passkeysHandler := PasskeysHandler(webAuthn, accessPolicy, sessionStore, stores.Passkeys, trustedProxies)
+		mux.Handle(passkeysPath, passkeysHandler)
+		mux.Handle(passkeysPath+"/", passkeysHandler)
+	}
+
+	mux.Handle(RetentionHandler(accessPolicy, sessionStore, stores.Retention))
+	mux.Handle(CleanCookiesHandler(stores, cronToken))
+	mux.Handle(RetentionSweepHandler(notificationBus, blobStore, stores, cronToken))
 	mux.Handle(HealthHandler())
 	mux.Handle("/", http.FileServer(http.Dir("static")))
 
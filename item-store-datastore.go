@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreItemStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreItemStore(c *datastore.Client) *datastoreItemStore {
+	return &datastoreItemStore{
+		c: c,
+	}
+}
+
+func clipItemKey(object string) *datastore.Key {
+	return datastore.NameKey(clipItemKind, object, nil)
+}
+
+func (s *datastoreItemStore) Put(ctx context.Context, item *clipItem) error {
+	_, err := s.c.Put(ctx, clipItemKey(item.Object), item)
+
+	return err
+}
+
+func (s *datastoreItemStore) List(ctx context.Context, user string, query itemQuery) ([]*clipItem, error) {
+	// Needs the composite index on User and descending ID in index.yaml
+	q := datastore.NewQuery(clipItemKind).Filter("User =", user).Order("-ID")
+
+	if query.From != "" {
+		q = q.Filter("ID >=", query.From)
+	}
+
+	if query.Before != "" {
+		q = q.Filter("ID <", query.Before)
+	}
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+
+	items := []*clipItem{}
+
+	if _, err := s.c.GetAll(ctx, q, &items); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (s *datastoreItemStore) Get(ctx context.Context, object string) (*clipItem, error) {
+	var item clipItem
+
+	if err := s.c.Get(ctx, clipItemKey(object), &item); err == datastore.ErrNoSuchEntity {
+		return nil, errorItemNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+func (s *datastoreItemStore) Count(ctx context.Context, user string) (int, error) {
+	return s.c.Count(ctx, datastore.NewQuery(clipItemKind).Filter("User =", user).KeysOnly())
+}
+
+func (s *datastoreItemStore) Delete(ctx context.Context, object string) (*clipItem, error) {
+	key := clipItemKey(object)
+
+	var item clipItem
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &item); err == datastore.ErrNoSuchEntity {
+			return errorItemNotFound
+		} else if err != nil {
+			return err
+		}
+
+		return tx.Delete(key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &item, nil
+}
+
+func (s *datastoreItemStore) Reassign(ctx context.Context, from string, to string) error {
+	var items []*clipItem
+
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(clipItemKind).Filter("User =", from), &items)
+
+	if err != nil {
+		return err
+	}
+
+	newKeys := make([]*datastore.Key, len(items))
+
+	for i, item := range items {
+		item.User = to
+		item.Object = itemObjectName(to, item.ID)
+		newKeys[i] = clipItemKey(item.Object)
+	}
+
+	// Object names are the keys, so the items are written under new keys before the old ones are removed
+	return datastoreBatches(len(keys), func(start int, end int) error {
+		if _, err := s.c.PutMulti(ctx, newKeys[start:end], items[start:end]); err != nil {
+			return err
+		}
+
+		return s.c.DeleteMulti(ctx, keys[start:end])
+	})
+}
+
+func (s *datastoreItemStore) Expired(ctx context.Context, now time.Time) ([]*clipItem, error) {
+	items := []*clipItem{}
+
+	// Items without an expiry have the zero time, which is excluded by the lower bound
+	q := datastore.NewQuery(clipItemKind).Filter("Expiry >", time.Time{}).Filter("Expiry <", now)
+
+	if _, err := s.c.GetAll(ctx, q, &items); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (s *datastoreItemStore) Objects(ctx context.Context) ([]string, error) {
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(clipItemKind).KeysOnly(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]string, len(keys))
+
+	for i, key := range keys {
+		objects[i] = key.Name
+	}
+
+	return objects, nil
+}
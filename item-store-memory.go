@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryItemStore keeps the item index for the lifetime of the process, keyed by object name
+type memoryItemStore struct {
+	lock  sync.Mutex
+	items map[string]clipItem
+}
+
+func newMemoryItemStore() *memoryItemStore {
+	return &memoryItemStore{
+		items: make(map[string]clipItem),
+	}
+}
+
+func (s *memoryItemStore) Put(ctx context.Context, item *clipItem) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.items[item.Object] = *item
+
+	return nil
+}
+
+func (s *memoryItemStore) List(ctx context.Context, user string, query itemQuery) ([]*clipItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	items := []*clipItem{}
+
+	for _, item := range s.items {
+		if item.User != user || query.From != "" && item.ID < query.From || query.Before != "" && item.ID >= query.Before {
+			continue
+		}
+
+		item := item
+		items = append(items, &item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].ID > items[j].ID
+	})
+
+	if query.Offset >= len(items) {
+		return []*clipItem{}, nil
+	}
+
+	items = items[query.Offset:]
+
+	if query.Limit > 0 && len(items) > query.Limit {
+		items = items[:query.Limit]
+	}
+
+	return items, nil
+}
+
+func (s *memoryItemStore) Get(ctx context.Context, object string) (*clipItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item, found := s.items[object]
+
+	if !found {
+		return nil, errorItemNotFound
+	}
+
+	return &item, nil
+}
+
+func (s *memoryItemStore) Count(ctx context.Context, user string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+
+	for _, item := range s.items {
+		if item.User == user {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryItemStore) Delete(ctx context.Context, object string) (*clipItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item, found := s.items[object]
+
+	if !found {
+		return nil, errorItemNotFound
+	}
+
+	delete(s.items, object)
+
+	return &item, nil
+}
+
+func (s *memoryItemStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for object, item := range s.items {
+		if item.User == from {
+			delete(s.items, object)
+
+			item.User = to
+			item.Object = itemObjectName(to, item.ID)
+			s.items[item.Object] = item
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryItemStore) Expired(ctx context.Context, now time.Time) ([]*clipItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	items := []*clipItem{}
+
+	for _, item := range s.items {
+		if item.expired(now) {
+			item := item
+			items = append(items, &item)
+		}
+	}
+
+	return items, nil
+}
+
+func (s *memoryItemStore) Objects(ctx context.Context) ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objects := []string{}
+
+	for object := range s.items {
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteItemStore struct {
+	db *sql.DB
+}
+
+func newSQLiteItemStore(db *sql.DB) *sqliteItemStore {
+	return &sqliteItemStore{
+		db: db,
+	}
+}
+
+const sqliteItemColumns = "object, user, id, name, type, size, created, preview, expiry"
+
+func scanSQLiteItem(row sqliteScanner) (*clipItem, error) {
+	var item clipItem
+
+	var created, expiry int64
+
+	if err := row.Scan(&item.Object, &item.User, &item.ID, &item.Name, &item.Type, &item.Size, &created, &item.Preview, &expiry); err != nil {
+		return nil, err
+	}
+
+	item.Created = fromSQLiteTime(created)
+	item.Expiry = fromSQLiteTime(expiry)
+
+	return &item, nil
+}
+
+func (s *sqliteItemStore) Put(ctx context.Context, item *clipItem) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO clip_items ("+sqliteItemColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		item.Object, item.User, item.ID, item.Name, item.Type, item.Size, sqliteTime(item.Created), item.Preview, sqliteTime(item.Expiry))
+
+	return err
+}
+
+func (s *sqliteItemStore) List(ctx context.Context, user string, query itemQuery) ([]*clipItem, error) {
+	statement := "SELECT " + sqliteItemColumns + " FROM clip_items WHERE user = ?"
+
+	args := []interface{}{user}
+
+	if query.From != "" {
+		statement += " AND id >= ?"
+		args = append(args, query.From)
+	}
+
+	if query.Before != "" {
+		statement += " AND id < ?"
+		args = append(args, query.Before)
+	}
+
+	statement += " ORDER BY id DESC"
+
+	// SQLite only takes an offset after a limit, where a negative limit is no limit
+	if query.Limit > 0 || query.Offset > 0 {
+		limit := query.Limit
+
+		if limit == 0 {
+			limit = -1
+		}
+
+		statement += " LIMIT ? OFFSET ?"
+		args = append(args, limit, query.Offset)
+	}
+
+	return s.query(ctx, statement, args...)
+}
+
+func (s *sqliteItemStore) query(ctx context.Context, statement string, args ...interface{}) ([]*clipItem, error) {
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := []*clipItem{}
+
+	for rows.Next() {
+		item, err := scanSQLiteItem(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s *sqliteItemStore) Get(ctx context.Context, object string) (*clipItem, error) {
+	item, err := scanSQLiteItem(s.db.QueryRowContext(ctx, "SELECT "+sqliteItemColumns+" FROM clip_items WHERE object = ?", object))
+
+	if err == sql.ErrNoRows {
+		return nil, errorItemNotFound
+	}
+
+	return item, err
+}
+
+func (s *sqliteItemStore) Count(ctx context.Context, user string) (int, error) {
+	var count int
+
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM clip_items WHERE user = ?", user).Scan(&count)
+
+	return count, err
+}
+
+func (s *sqliteItemStore) Delete(ctx context.Context, object string) (*clipItem, error) {
+	item, err := scanSQLiteItem(s.db.QueryRowContext(ctx, "DELETE FROM clip_items WHERE object = ? RETURNING "+sqliteItemColumns, object))
+
+	if err == sql.ErrNoRows {
+		return nil, errorItemNotFound
+	}
+
+	return item, err
+}
+
+func (s *sqliteItemStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE clip_items SET user = ?, object = ? || '/' || id WHERE user = ?", to, to, from)
+
+	return err
+}
+
+func (s *sqliteItemStore) Expired(ctx context.Context, now time.Time) ([]*clipItem, error) {
+	return s.query(ctx, "SELECT "+sqliteItemColumns+" FROM clip_items WHERE expiry > 0 AND expiry < ?", sqliteTime(now))
+}
+
+func (s *sqliteItemStore) Objects(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT object FROM clip_items")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	objects := []string{}
+
+	for rows.Next() {
+		var object string
+
+		if err := rows.Scan(&object); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, rows.Err()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const clipItemKind = "ClipItem"
+
+// maxPreviewSize limits how much of an item's text is kept in the index
+const maxPreviewSize = 4096
+
+var errorItemNotFound = errors.New("Item not found")
+
+// clipItem indexes a stored clipboard item, so that items can be listed without listing blobs
+type clipItem struct {
+	User    string
+	ID      string
+	Name    string
+	Type    string
+	Size    int64
+	Created time.Time
+	// Object is the name of the blob holding the item
+	Object string
+	// Preview is the start of the item's text, for clipboard text
+	Preview string `datastore:",noindex"`
+	// Expiry is when the item is deleted, or zero for an item kept until the user's retention settings remove it
+	Expiry time.Time
+}
+
+func (item *clipItem) expired(now time.Time) bool {
+	return !item.Expiry.IsZero() && item.Expiry.Before(now)
+}
+
+// itemQuery selects a user's items by ID, which sort by creation time
+type itemQuery struct {
+	// From is the ID of the oldest item to find, or empty for no bound
+	From string
+	// Before excludes items with this ID and newer ones, or is empty for no bound
+	Before string
+	// Offset skips this many of the newest matching items
+	Offset int
+	// Limit is how many items to find, or 0 for no limit
+	Limit int
+}
+
+// ItemStore persists the index of clipboard items, keyed by object name
+type ItemStore interface {
+	// Put indexes an item, replacing any earlier entry for its object
+	Put(ctx context.Context, item *clipItem) error
+	// List finds a user's items matching the query, newest first
+	List(ctx context.Context, user string, query itemQuery) ([]*clipItem, error)
+	// Get finds the item stored under an object name, returning errorItemNotFound if there is none
+	Get(ctx context.Context, object string) (*clipItem, error)
+	Count(ctx context.Context, user string) (int, error)
+	// Delete removes the item stored under an object name, returning it, or errorItemNotFound if there is none
+	Delete(ctx context.Context, object string) (*clipItem, error)
+	// Reassign moves every item of a user to another user ID, along with their object names
+	Reassign(ctx context.Context, from string, to string) error
+	// Expired finds every item with an expiry before now
+	Expired(ctx context.Context, now time.Time) ([]*clipItem, error)
+	// Objects lists the object names of every indexed item
+	Objects(ctx context.Context) ([]string, error)
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const itemsPath = "/items"
+
+const itemsBulkDeletePath = itemsPath + "/delete"
+
+const itemContentSuffix = "/content"
+
+// itemsDeletedEvent tells a user's event streams that clipboard items have been deleted
+const itemsDeletedEvent = "deleted"
+
+const (
+	defaultItemsPageSize = 50
+	maxItemsPageSize     = 200
+)
+
+// maxBulkDeleteIDs limits how many items may be named in one bulk delete
+const maxBulkDeleteIDs = 1000
+
+// Item IDs are the hex creation time in nanoseconds followed by hex random bytes
+const (
+	itemIDTimeLength = 16
+	itemIDRandomSize = 4
+)
+
+var errorInvalidItemID = errors.New("Invalid item ID")
+
+type itemsDeletedNotification struct {
+	Event string
+	IDs   []string
+}
+
+// itemsPage is a page of a user's items, newest first.
+// Next is the cursor for the page of older items, and is empty on the last page.
+type itemsPage struct {
+	Items []*fileNotification
+	Next  string
+	// Total is how many items the user has
+	Total int
+}
+
+// bulkDeleteRequest names the items to delete, or the range of times they were created in, with Until excluded
+type bulkDeleteRequest struct {
+	IDs   []string
+	Since time.Time
+	Until time.Time
+}
+
+// itemIDAt gives the ID of an item created at a time, as IDs sort items by creation time.
+// It sorts before the IDs of every item created at that time, so bounds queries by time.
+func itemIDAt(t time.Time) string {
+	return fmt.Sprintf("%016x", t.UnixNano())
+}
+
+// newItemID gives an ID for an item created now, with random bits after the time so that items uploaded at once do not collide
+func newItemID() (string, error) {
+	suffix := make([]byte, itemIDRandomSize)
+
+	if _, err := io.ReadFull(rand.Reader, suffix); err != nil {
+		return "", err
+	}
+
+	return itemIDAt(time.Now()) + hex.EncodeToString(suffix), nil
+}
+
+// itemObjectName gives the name an item is stored under in the blob store
+func itemObjectName(user string, id string) string {
+	return user + "/" + id
+}
+
+// itemContentType gives the type an item is downloaded as, serving clipboard text as plain text
+func itemContentType(item *clipItem) string {
+	switch item.Type {
+	case "":
+		return "application/octet-stream"
+	case clipboardMimeType:
+		return "text/plain; charset=utf-8"
+	default:
+		return item.Type
+	}
+}
+
+// serveItemContent streams an item from storage, supporting ranges and conditional requests
+func serveItemContent(w http.ResponseWriter, r *http.Request, blobStore BlobStore, object string) {
+	attrs, err := blobStore.Attrs(r.Context(), object)
+
+	if err == errorBlobNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error getting item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	item := newClipItem(attrs, "")
+
+	if item.expired(time.Now()) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Items are never changed once uploaded, so their IDs identify their content
+	w.Header().Set("ETag", `"`+item.ID+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	w.Header().Set("Content-Type", itemContentType(item))
+	w.Header().Set("Content-Disposition", contentDisposition(item.Name))
+	// Uploads are served from this origin, so must never be run as pages
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	content := newBlobReadSeeker(r.Context(), blobStore, attrs.Name, attrs.Size)
+
+	defer content.Close()
+
+	http.ServeContent(w, r, "", item.Created, content)
+}
+
+// itemContentPath gives the path an item's content is downloaded from
+func itemContentPath(id string) string {
+	return itemsPath + "/" + id + itemContentSuffix
+}
+
+// contentDisposition makes an attachment header from an uploaded name, dropping anything which could escape the file name
+func contentDisposition(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f || r == '/' || r == '\\' {
+			return -1
+		}
+
+		return r
+	}, path.Base("/"+name))
+
+	if name == "" || name == "/" || name == "." || name == ".." {
+		name = "download"
+	}
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	})
+
+	if disposition == "" {
+		return "attachment"
+	}
+
+	return disposition
+}
+
+// splitObjectName gives the user and ID of the item stored under a blob name
+func splitObjectName(objectName string) (string, string) {
+	separator := strings.LastIndex(objectName, "/")
+
+	if separator < 0 {
+		return "", objectName
+	}
+
+	return objectName[:separator], objectName[separator+1:]
+}
+
+// checkItemID makes sure an ID from a client cannot name anything but an item.
+// Items from before IDs had random bits only have the time.
+func checkItemID(id string) error {
+	if len(id) != itemIDTimeLength && len(id) != itemIDTimeLength+2*itemIDRandomSize {
+		return errorInvalidItemID
+	}
+
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return errorInvalidItemID
+		}
+	}
+
+	return nil
+}
+
+// deleteItem removes an item's blob and then its index entry, grants and usage, returning the grants removed.
+// The blob goes first so that a failure leaves the item indexed, to be deleted again, rather than a blob nothing finds.
+// Items are only found under the user's own prefix, so nobody else's can be deleted.
+func deleteItem(ctx context.Context, blobStore BlobStore, itemStore ItemStore, usageStore UsageStore, shareStore ShareStore, user string, id string) ([]*itemShare, error) {
+	object := itemObjectName(user, id)
+
+	if err := blobStore.Delete(ctx, object); err != nil && err != errorBlobNotFound {
+		return nil, err
+	}
+
+	item, err := itemStore.Delete(ctx, object)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Once the item is gone from the index it is not deleted again, so its usage is released even if its grants are not removed
+	shares, shareErr := shareStore.DeleteItem(ctx, user, id)
+
+	if err := releaseUsage(ctx, usageStore, user, item.Size); err != nil {
+		return shares, err
+	}
+
+	return shares, shareErr
+}
+
+// deleteItems removes a user's items and tells their devices and those of anyone they were shared with,
+// returning the IDs of the items deleted, even if there is an error.
+// Items which do not exist are skipped.
+func deleteItems(ctx context.Context, notificationBus NotificationBus, blobStore BlobStore, itemStore ItemStore, usageStore UsageStore, shareStore ShareStore, user string, ids []string) ([]string, error) {
+	deleted := []string{}
+
+	var revoked []*itemShare
+
+	var deleteErr error
+
+	for _, id := range ids {
+		shares, err := deleteItem(ctx, blobStore, itemStore, usageStore, shareStore, user, id)
+
+		if err == errorItemNotFound {
+			continue
+		} else if err != nil {
+			deleteErr = err
+			break
+		}
+
+		deleted = append(deleted, id)
+		revoked = append(revoked, shares...)
+	}
+
+	// Devices still need to hear about the items deleted before any error
+	if len(deleted) > 0 {
+		if err := publishItemsDeleted(ctx, notificationBus, user, deleted); err != nil {
+			log.Println("Error publishing deletion:", err)
+		}
+	}
+
+	if err := publishSharesRevoked(ctx, notificationBus, revoked); err != nil {
+		log.Println("Error publishing revoked shares:", err)
+	}
+
+	return deleted, deleteErr
+}
+
+// publishItemsDeleted tells every connected device of a user to drop the items
+func publishItemsDeleted(ctx context.Context, bus NotificationBus, user string, ids []string) error {
+	notificationData, err := json.Marshal(&itemsDeletedNotification{
+		Event: itemsDeletedEvent,
+		IDs:   ids,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bus.Publish(ctx, user, notificationData)
+}
+
+type itemsHandler struct {
+	notificationBus  NotificationBus
+	blobStore        BlobStore
+	accessPolicy     *AccessPolicy
+	sessionStore     SessionStore
+	accessTokenStore AccessTokenStore
+	itemStore        ItemStore
+	usageStore       UsageStore
+	shareStore       ShareStore
+	directoryStore   DirectoryStore
+	downloadURLs     *DownloadURLs
+}
+
+func (h *itemsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	shareID, shareRecipient, isSharePath := splitSharePath(r.URL.Path)
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == itemsPath:
+		h.list(w, r)
+	case r.Method == "POST" && isSharePath && shareRecipient == "":
+		h.share(w, r, shareID)
+	case r.Method == "GET" && isSharePath && shareRecipient == "":
+		h.listShares(w, r, shareID)
+	case r.Method == "DELETE" && isSharePath && shareRecipient != "":
+		h.unshare(w, r, shareID, shareRecipient)
+	case (r.Method == "GET" || r.Method == "HEAD") && strings.HasPrefix(r.URL.Path, itemsPath+"/") && strings.HasSuffix(r.URL.Path, itemContentSuffix):
+		h.content(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, itemsPath+"/"), itemContentSuffix))
+	case r.Method == "POST" && r.URL.Path == itemsBulkDeletePath:
+		h.bulkDelete(w, r)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, itemsPath+"/"):
+		h.delete(w, r, strings.TrimPrefix(r.URL.Path, itemsPath+"/"))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// list responds with a page of the user's items, newest first
+func (h *itemsHandler) list(w http.ResponseWriter, r *http.Request) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeRead)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := defaultItemsPageSize
+
+	if limitText := query.Get("limit"); limitText != "" {
+		limit, err = strconv.Atoi(limitText)
+
+		if err != nil || limit < 1 || limit > maxItemsPageSize {
+			http.Error(w, fmt.Sprint("Limit must be between 1 and ", maxItemsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before := query.Get("before")
+
+	if before != "" {
+		if err := checkItemID(before); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// One more item than the page holds shows whether there are older items
+	items, err := listItems(r.Context(), h.itemStore, h.shareStore, auth.User, itemQuery{
+		Before: before,
+		Limit:  limit + 1,
+	})
+
+	if err != nil {
+		log.Println("Error listing items:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	page := itemsPage{
+		Items: []*fileNotification{},
+	}
+
+	if len(items) > limit {
+		items = items[:limit]
+		page.Next = items[limit-1].ID
+	}
+
+	page.Total, err = countItems(r.Context(), h.itemStore, h.shareStore, auth.User)
+
+	if err != nil {
+		log.Println("Error counting items:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+
+	for _, item := range items {
+		if item.expired(now) {
+			// Waiting for the retention sweep
+			continue
+		}
+
+		notification, err := readFileNotification(r.Context(), h.blobStore, h.downloadURLs, item)
+
+		if err == errorBlobNotFound {
+			// Deleted since the listing was taken
+			continue
+		} else if err != nil {
+			log.Println("Error reading item:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		page.Items = append(page.Items, notification)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&page); err != nil {
+		log.Println("Error writing items:", err)
+	}
+}
+
+// content streams one of the user's items, or an item shared with them
+func (h *itemsHandler) content(w http.ResponseWriter, r *http.Request, id string) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeRead)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := checkItemID(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	object := itemObjectName(auth.User, id)
+
+	// Items shared with the user are served from their owner's blobs
+	if _, err := h.itemStore.Get(r.Context(), object); err == errorItemNotFound {
+		share, err := receivedShare(r.Context(), h.shareStore, auth.User, id)
+
+		if err == errorShareNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error finding shared item:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		object = share.object()
+	} else if err != nil {
+		log.Println("Error getting item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	serveItemContent(w, r, h.blobStore, object)
+}
+
+func (h *itemsHandler) delete(w http.ResponseWriter, r *http.Request, id string) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeDelete)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := checkItemID(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	shares, err := deleteItem(r.Context(), h.blobStore, h.itemStore, h.usageStore, h.shareStore, auth.User, id)
+
+	if err == errorItemNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error deleting item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := publishItemsDeleted(r.Context(), h.notificationBus, auth.User, []string{id}); err != nil {
+		log.Println("Error publishing deletion:", err)
+	}
+
+	if err := publishSharesRevoked(r.Context(), h.notificationBus, shares); err != nil {
+		log.Println("Error publishing revoked shares:", err)
+	}
+
+	fmt.Fprintln(w, "Deleted")
+}
+
+// bulkDelete deletes a list of items or every item created in a range of times, responding with the IDs deleted
+func (h *itemsHandler) bulkDelete(w http.ResponseWriter, r *http.Request) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeDelete)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var request bulkDeleteRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ids := request.IDs
+
+	switch {
+	case len(ids) > 0:
+		if !request.Since.IsZero() || !request.Until.IsZero() {
+			http.Error(w, "Give either IDs or a time range", http.StatusBadRequest)
+			return
+		}
+
+		if len(ids) > maxBulkDeleteIDs {
+			http.Error(w, "Too many IDs", http.StatusBadRequest)
+			return
+		}
+
+		for _, id := range ids {
+			if err := checkItemID(id); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case !request.Since.IsZero() || !request.Until.IsZero():
+		query := itemQuery{}
+
+		if !request.Since.IsZero() {
+			query.From = itemIDAt(request.Since)
+		}
+
+		if !request.Until.IsZero() {
+			query.Before = itemIDAt(request.Until)
+		}
+
+		items, err := h.itemStore.List(r.Context(), auth.User, query)
+
+		if err != nil {
+			log.Println("Error listing items:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+	default:
+		http.Error(w, "Give either IDs or a time range", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := deleteItems(r.Context(), h.notificationBus, h.blobStore, h.itemStore, h.usageStore, h.shareStore, auth.User, ids)
+
+	if err != nil {
+		log.Println("Error deleting item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(deleted); err != nil {
+		log.Println("Error writing deleted items:", err)
+	}
+}
+
+// ItemsHandler handles listing, downloading, sharing and deleting a user's clipboard items, under its path and the path of each item
+func ItemsHandler(notificationBus NotificationBus, blobStore BlobStore, accessPolicy *AccessPolicy, sessionStore SessionStore, accessTokenStore AccessTokenStore, itemStore ItemStore, usageStore UsageStore, shareStore ShareStore, directoryStore DirectoryStore, downloadURLs *DownloadURLs) (string, http.Handler) {
+	return itemsPath, &itemsHandler{
+		notificationBus:  notificationBus,
+		blobStore:        blobStore,
+		accessPolicy:     accessPolicy,
+		sessionStore:     sessionStore,
+		accessTokenStore: accessTokenStore,
+		itemStore:        itemStore,
+		usageStore:       usageStore,
+		shareStore:       shareStore,
+		directoryStore:   directoryStore,
+		downloadURLs:     downloadURLs,
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// keyCacheDefaultMaxAge is used when the key server does not say how long its keys may be cached
+const keyCacheDefaultMaxAge = time.Hour
+
+// keyCacheRetryInterval limits how often keys are refetched after a failure or for an unknown kid
+const keyCacheRetryInterval = time.Minute
+
+// KeyCache holds a JWK set, refreshing it as its cache lifetime runs out
+type KeyCache struct {
+	url string
+	// fetchLock lets one refresh run at a time, without holding lock while fetching
+	fetchLock sync.Mutex
+	lock      sync.Mutex
+	keys      []Key
+	expiry    time.Time
+	lastFetch time.Time
+}
+
+// NewKeyCache creates a cache for the JWK set at url, which is fetched on first use
+func NewKeyCache(url string) *KeyCache {
+	return &KeyCache{
+		url: url,
+	}
+}
+
+func containsKid(keys []Key, kid string) bool {
+	for _, key := range keys {
+		if key.Kid == kid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// needsRefresh checks whether the keys have expired or kid is not among them, and gives the cached keys.
+// It must be called with lock held.
+func (c *KeyCache) needsRefresh(kid string, now time.Time) (keys []Key, refresh bool, stale bool) {
+	stale = now.After(c.expiry)
+	unknownKid := !containsKid(c.keys, kid) && now.Sub(c.lastFetch) > keyCacheRetryInterval
+
+	return c.keys, c.keys == nil || stale || unknownKid, stale
+}
+
+// Keys returns the cached keys, refreshing them if they have expired or kid is not among them.
+// Keys are fetched without holding the cache lock, so verifications needing no refresh never wait on the key server.
+func (c *KeyCache) Keys(kid string) ([]Key, error) {
+	c.lock.Lock()
+	keys, refresh, _ := c.needsRefresh(kid, time.Now())
+	c.lock.Unlock()
+
+	if !refresh {
+		return keys, nil
+	}
+
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	// Another caller may have refreshed the keys while this one waited
+	now := time.Now()
+
+	c.lock.Lock()
+	keys, refresh, stale := c.needsRefresh(kid, now)
+	c.lastFetch = now
+	c.lock.Unlock()
+
+	if !refresh {
+		return keys, nil
+	}
+
+	fetched, maxAge, maxAgeFound, err := FetchKeys(c.url)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		if c.keys == nil {
+			return nil, err
+		}
+
+		log.Println("Failed to refresh keys, keeping last good keys:", err)
+
+		if stale {
+			c.expiry = now.Add(keyCacheRetryInterval)
+		}
+
+		return c.keys, nil
+	}
+
+	if !maxAgeFound {
+		maxAge = keyCacheDefaultMaxAge
+	}
+
+	c.keys = fetched
+	c.expiry = now.Add(maxAge)
+
+	return c.keys, nil
+}
+
+// VerifyToken verifies the given token against the cached keys
+func (c *KeyCache) VerifyToken(token string, requirements TokenRequirements) (id string, email string, err error) {
+	header, err := parseTokenHeader(token)
+
+	if err != nil {
+		return
+	}
+
+	keys, err := c.Keys(header.Kid)
+
+	if err != nil {
+		return
+	}
+
+	return VerifyToken(token, keys, requirements)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const memorySubscriptionBuffer = 64
+
+// NotificationSubscription receives the notifications published to a user's topic
+type NotificationSubscription interface {
+	// Receive calls f for each notification until ctx is done
+	Receive(ctx context.Context, f func(data []byte)) error
+}
+
+// NotificationBus fans notifications out to every connection of a user
+type NotificationBus interface {
+	Publish(ctx context.Context, userIDHash string, data []byte) error
+	// Subscribe creates a subscription to the user's topic, which is removed once ctx is done
+	Subscribe(ctx context.Context, userIDHash string) (NotificationSubscription, error)
+	// DeleteTopic removes the user's topic, which is created again if it is used
+	DeleteTopic(ctx context.Context, userIDHash string) error
+}
+
+func openNotificationBus(ctx context.Context, projectID string) (NotificationBus, error) {
+	busKind, busKindDeclared := os.LookupEnv("NOTIFICATION_BUS")
+
+	if !busKindDeclared {
+		busKind = "pubsub"
+		log.Println("Notification bus not declared, defaulting to", busKind)
+	}
+
+	switch busKind {
+	case "pubsub":
+		if projectID == "" {
+			return nil, errors.New("Project ID not declared")
+		}
+
+		log.Println("Connecting to PubSub")
+		pubsubClient, err := pubsub.NewClient(ctx, projectID)
+		if err != nil {
+			return nil, err
+		}
+
+		return newPubsubBus(pubsubClient), nil
+	case "memory":
+		log.Println("Using in-memory notification bus")
+		return newMemoryBus(), nil
+	default:
+		return nil, fmt.Errorf("Unknown notification bus %q", busKind)
+	}
+}
+
+// memoryBus is a notification bus for single instance deployments
+type memoryBus struct {
+	lock   sync.Mutex
+	topics map[string]map[*memorySubscription]struct{}
+}
+
+type memorySubscription struct {
+	messages chan []byte
+}
+
+func newMemoryBus() *memoryBus {
+	return &memoryBus{
+		topics: make(map[string]map[*memorySubscription]struct{}),
+	}
+}
+
+func (b *memoryBus) Publish(ctx context.Context, userIDHash string, data []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for sub := range b.topics[userIDHash] {
+		select {
+		case sub.messages <- data:
+		default:
+			log.Println("Dropping notification for slow subscriber of", userIDHash)
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBus) Subscribe(ctx context.Context, userIDHash string) (NotificationSubscription, error) {
+	sub := &memorySubscription{
+		messages: make(chan []byte, memorySubscriptionBuffer),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	topic, topicExists := b.topics[userIDHash]
+
+	if !topicExists {
+		topic = make(map[*memorySubscription]struct{})
+		b.topics[userIDHash] = topic
+	}
+
+	topic[sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		delete(topic, sub)
+
+		if len(topic) == 0 {
+			delete(b.topics, userIDHash)
+		}
+
+		close(sub.messages)
+	}()
+
+	return sub, nil
+}
+
+// DeleteTopic does nothing, as memory topics only exist while they have subscribers
+func (b *memoryBus) DeleteTopic(ctx context.Context, userIDHash string) error {
+	return nil
+}
+
+func (s *memorySubscription) Receive(ctx context.Context, f func(data []byte)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case data, ok := <-s.messages:
+			if !ok {
+				return nil
+			}
+
+			f(data)
+		}
+	}
+}
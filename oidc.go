@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const discoveryPath = "/.well-known/openid-configuration"
+
+const googleProviderName = "google"
+
+const defaultTokenClockSkew = time.Minute
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+var errorUnknownIssuer = errors.New("Unknown token issuer")
+
+// OIDCProviderConfig configures an OpenID Connect provider to be found through discovery
+type OIDCProviderConfig struct {
+	Name      string
+	Issuer    string
+	ClientIDs []string
+	// HostedDomain restricts logins to a Google Workspace domain, for providers which set the hd claim
+	HostedDomain string
+}
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// OIDCProvider is an identity provider whose ID tokens are accepted for login
+type OIDCProvider struct {
+	Name         string
+	requirements TokenRequirements
+	keys         *KeyCache
+	// bareSubjects keys users by their subject alone, which Google users were keyed by before other providers were supported
+	bareSubjects bool
+}
+
+// OIDCProviders are all the identity providers accepted for login
+type OIDCProviders []*OIDCProvider
+
+// NewGoogleProvider creates the provider for Google Sign-In
+func NewGoogleProvider(clientIDs []string, hostedDomain string, keysURL string) *OIDCProvider {
+	return &OIDCProvider{
+		Name: googleProviderName,
+		requirements: TokenRequirements{
+			Issuers:      googleIssuers,
+			Audiences:    clientIDs,
+			HostedDomain: hostedDomain,
+		},
+		keys:         NewKeyCache(keysURL),
+		bareSubjects: true,
+	}
+}
+
+// DiscoverProvider fetches a provider's discovery document to find its keys
+func DiscoverProvider(config OIDCProviderConfig) (*OIDCProvider, error) {
+	r, err := oidcHTTPClient.Get(strings.TrimSuffix(config.Issuer, "/") + discoveryPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching discovery document: %s", r.Status)
+	}
+
+	var document discoveryDocument
+
+	if err := json.NewDecoder(r.Body).Decode(&document); err != nil {
+		return nil, err
+	}
+
+	if document.Issuer != config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", document.Issuer)
+	}
+
+	if document.JWKSURI == "" {
+		return nil, errors.New("discovery document has no jwks_uri")
+	}
+
+	return &OIDCProvider{
+		Name: config.Name,
+		requirements: TokenRequirements{
+			Issuers:      []string{config.Issuer},
+			Audiences:    config.ClientIDs,
+			HostedDomain: config.HostedDomain,
+		},
+		keys: NewKeyCache(document.JWKSURI),
+	}, nil
+}
+
+// UserKey identifies a user of this provider by their subject
+func (p *OIDCProvider) UserKey(sub string) string {
+	if p.bareSubjects {
+		return sub
+	}
+
+	return p.requirements.Issuers[0] + " " + sub
+}
+
+// VerifyToken verifies a token issued by this provider
+func (p *OIDCProvider) VerifyToken(token string) (id string, email string, err error) {
+	return p.keys.VerifyToken(token, p.requirements)
+}
+
+// VerifyToken finds the provider which issued a token and verifies it
+func (ps OIDCProviders) VerifyToken(token string) (provider *OIDCProvider, id string, email string, err error) {
+	body, err := parseUnverifiedTokenBody(token)
+
+	if err != nil {
+		return
+	}
+
+	for _, p := range ps {
+		if containsString(p.requirements.Issuers, body.Iss) {
+			provider = p
+			id, email, err = p.VerifyToken(token)
+			return
+		}
+	}
+
+	err = errorUnknownIssuer
+	return
+}
+
+func loadOIDCProviders() (OIDCProviders, error) {
+	providers := OIDCProviders{}
+
+	googleLoginAppID, googleLoginAppIDDeclared := os.LookupEnv("GOOGLE_SIGN_IN_APP_ID")
+
+	if googleLoginAppIDDeclared {
+		googleKeysURL, googleKeysURLDeclared := os.LookupEnv("GOOGLE_KEYS_URL")
+
+		if !googleKeysURLDeclared {
+			googleKeysURL = defaultGoogleKeysURL
+		}
+
+		// Further client IDs, such as those of native apps, may follow the web client ID
+		googleClientIDs := strings.Split(googleLoginAppID, ",")
+
+		providers = append(providers, NewGoogleProvider(googleClientIDs, os.Getenv("GOOGLE_HOSTED_DOMAIN"), googleKeysURL))
+	} else {
+		log.Println("Google Login App ID not declared, Google Sign-In is disabled")
+	}
+
+	if providersJSON, providersDeclared := os.LookupEnv("OIDC_PROVIDERS"); providersDeclared {
+		var configs []OIDCProviderConfig
+
+		if err := json.Unmarshal([]byte(providersJSON), &configs); err != nil {
+			return nil, fmt.Errorf("parsing OIDC providers: %v", err)
+		}
+
+		// Names identify providers in the logs, so two providers of one name could not be told apart
+		names := map[string]bool{
+			googleProviderName: true,
+		}
+
+		for _, config := range configs {
+			if config.Name == "" || names[config.Name] || config.Issuer == "" || len(config.ClientIDs) == 0 {
+				return nil, fmt.Errorf("OIDC provider %q needs a unique name, an issuer and client IDs", config.Name)
+			}
+
+			names[config.Name] = true
+
+			log.Println("Discovering OIDC provider", config.Name, "at", config.Issuer)
+			provider, err := DiscoverProvider(config)
+			if err != nil {
+				return nil, fmt.Errorf("discovering OIDC provider %s: %v", config.Name, err)
+			}
+
+			providers = append(providers, provider)
+		}
+	}
+
+	if len(providers) == 0 {
+		log.Println("No OIDC providers configured")
+	}
+
+	clockSkew := defaultTokenClockSkew
+
+	if clockSkewText, clockSkewDeclared := os.LookupEnv("TOKEN_CLOCK_SKEW"); clockSkewDeclared {
+		var err error
+
+		clockSkew, err = time.ParseDuration(clockSkewText)
+
+		if err != nil {
+			return nil, fmt.Errorf("parsing token clock skew: %v", err)
+		}
+	}
+
+	for _, provider := range providers {
+		provider.requirements.ClockSkew = clockSkew
+	}
+
+	return providers, nil
+}
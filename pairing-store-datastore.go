@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastorePairingStore struct {
+	c *datastore.Client
+}
+
+func newDatastorePairingStore(c *datastore.Client) *datastorePairingStore {
+	return &datastorePairingStore{
+		c: c,
+	}
+}
+
+func pairingKey(deviceCode string) *datastore.Key {
+	return datastore.NameKey(pairingKind, hashToken(deviceCode), nil)
+}
+
+func (s *datastorePairingStore) Create(ctx context.Context, request *pairingRequest) error {
+	_, err := s.c.Put(ctx, pairingKey(request.DeviceCode), request)
+
+	return err
+}
+
+func (s *datastorePairingStore) Approve(ctx context.Context, userCode string, approver *sessionCookie, now time.Time) (*pairingRequest, error) {
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(pairingKind).Filter("UserCode =", userCode).KeysOnly(), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		var request pairingRequest
+
+		_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			if err := tx.Get(key, &request); err == datastore.ErrNoSuchEntity {
+				return errorPairingNotFound
+			} else if err != nil {
+				return err
+			}
+
+			if request.User != "" || !now.Before(request.Expiry) {
+				return errorPairingNotFound
+			}
+
+			request.User = approver.User
+			request.UserKey = approver.UserKey
+			request.Email = approver.Email
+
+			_, err := tx.Put(key, &request)
+
+			return err
+		})
+
+		if err == errorPairingNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		return &request, nil
+	}
+
+	return nil, errorPairingNotFound
+}
+
+func (s *datastorePairingStore) Poll(ctx context.Context, deviceCode string, now time.Time) (*pairingRequest, error) {
+	key := pairingKey(deviceCode)
+
+	var request pairingRequest
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &request); err == datastore.ErrNoSuchEntity {
+			return errorPairingNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if request.User != "" {
+			return tx.Delete(key)
+		}
+
+		polledRequest := request
+		polledRequest.LastPolled = now
+
+		_, err := tx.Put(key, &polledRequest)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.DeviceCode = deviceCode
+
+	return &request, nil
+}
+
+func (s *datastorePairingStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	return datastoreDeleteMatching(ctx, s.c, datastore.NewQuery(pairingKind).Filter("Expiry <", now))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryPairingStore keeps pairing requests for the lifetime of the process, keyed by device code hash
+type memoryPairingStore struct {
+	lock     sync.Mutex
+	requests map[string]pairingRequest
+}
+
+func newMemoryPairingStore() *memoryPairingStore {
+	return &memoryPairingStore{
+		requests: make(map[string]pairingRequest),
+	}
+}
+
+func (s *memoryPairingStore) Create(ctx context.Context, request *pairingRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storedRequest := *request
+	storedRequest.DeviceCode = ""
+
+	s.requests[hashToken(request.DeviceCode)] = storedRequest
+
+	return nil
+}
+
+func (s *memoryPairingStore) Approve(ctx context.Context, userCode string, approver *sessionCookie, now time.Time) (*pairingRequest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for codeHash, request := range s.requests {
+		if request.UserCode == userCode && request.User == "" && now.Before(request.Expiry) {
+			request.User = approver.User
+			request.UserKey = approver.UserKey
+			request.Email = approver.Email
+			s.requests[codeHash] = request
+
+			return &request, nil
+		}
+	}
+
+	return nil, errorPairingNotFound
+}
+
+func (s *memoryPairingStore) Poll(ctx context.Context, deviceCode string, now time.Time) (*pairingRequest, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	codeHash := hashToken(deviceCode)
+
+	request, found := s.requests[codeHash]
+
+	if !found {
+		return nil, errorPairingNotFound
+	}
+
+	if request.User != "" {
+		delete(s.requests, codeHash)
+	} else {
+		polledRequest := request
+		polledRequest.LastPolled = now
+		s.requests[codeHash] = polledRequest
+	}
+
+	request.DeviceCode = deviceCode
+
+	return &request, nil
+}
+
+func (s *memoryPairingStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for codeHash, request := range s.requests {
+		if request.Expiry.Before(now) {
+			delete(s.requests, codeHash)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqlitePairingStore struct {
+	db *sql.DB
+}
+
+func newSQLitePairingStore(db *sql.DB) *sqlitePairingStore {
+	return &sqlitePairingStore{
+		db: db,
+	}
+}
+
+const sqlitePairingColumns = "user_code, device_name, user_agent, ip, created, expiry, last_polled, user, user_key, email"
+
+func scanSQLitePairing(row sqliteScanner) (*pairingRequest, error) {
+	var request pairingRequest
+
+	var created, expiry, lastPolled int64
+
+	if err := row.Scan(&request.UserCode, &request.DeviceName, &request.UserAgent, &request.IP, &created, &expiry, &lastPolled, &request.User, &request.UserKey, &request.Email); err != nil {
+		return nil, err
+	}
+
+	request.Created = fromSQLiteTime(created)
+	request.Expiry = fromSQLiteTime(expiry)
+	request.LastPolled = fromSQLiteTime(lastPolled)
+
+	return &request, nil
+}
+
+func (s *sqlitePairingStore) Create(ctx context.Context, request *pairingRequest) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO pairing_requests (device_code_hash, "+sqlitePairingColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hashToken(request.DeviceCode), request.UserCode, request.DeviceName, request.UserAgent, request.IP, sqliteTime(request.Created), sqliteTime(request.Expiry), sqliteTime(request.LastPolled), request.User, request.UserKey, request.Email)
+
+	return err
+}
+
+func (s *sqlitePairingStore) Approve(ctx context.Context, userCode string, approver *sessionCookie, now time.Time) (*pairingRequest, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE pairing_requests SET user = ?, user_key = ?, email = ? WHERE user_code = ? AND user = '' AND expiry > ?", approver.User, approver.UserKey, approver.Email, userCode, sqliteTime(now))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if updated == 0 {
+		return nil, errorPairingNotFound
+	}
+
+	request, err := scanSQLitePairing(tx.QueryRowContext(ctx, "SELECT "+sqlitePairingColumns+" FROM pairing_requests WHERE user_code = ?", userCode))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return request, tx.Commit()
+}
+
+func (s *sqlitePairingStore) Poll(ctx context.Context, deviceCode string, now time.Time) (*pairingRequest, error) {
+	codeHash := hashToken(deviceCode)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	request, err := scanSQLitePairing(tx.QueryRowContext(ctx, "SELECT "+sqlitePairingColumns+" FROM pairing_requests WHERE device_code_hash = ?", codeHash))
+
+	if err == sql.ErrNoRows {
+		return nil, errorPairingNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if request.User != "" {
+		_, err = tx.ExecContext(ctx, "DELETE FROM pairing_requests WHERE device_code_hash = ?", codeHash)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE pairing_requests SET last_polled = ? WHERE device_code_hash = ?", sqliteTime(now), codeHash)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.DeviceCode = deviceCode
+
+	return request, tx.Commit()
+}
+
+func (s *sqlitePairingStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM pairing_requests WHERE expiry < ?", sqliteTime(now))
+
+	return err
+}
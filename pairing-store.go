@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errorPairingNotFound = errors.New("Pairing request not found")
+
+// PairingStore persists requests from headless devices to be signed in
+type PairingStore interface {
+	Create(ctx context.Context, request *pairingRequest) error
+	// Approve signs in the unexpired, unapproved request with the user code as the approver, returning errorPairingNotFound if there is none
+	Approve(ctx context.Context, userCode string, approver *sessionCookie, now time.Time) (*pairingRequest, error)
+	// Poll records that the device polled its request, returning the request as it was before.
+	// Approved requests are removed, so that only one poll receives a session.
+	// Returns errorPairingNotFound if there is no such request.
+	Poll(ctx context.Context, deviceCode string, now time.Time) (*pairingRequest, error)
+	// DeleteExpired removes every request which expired before now
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
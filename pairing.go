@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const pairingKind = "PairingRequest"
+
+const pairPath = "/pair"
+
+const pairApprovePath = pairPath + "/approve"
+
+const pairTokenPath = pairPath + "/token"
+
+// pairingLifetime is how long a device has for its user to approve it
+const pairingLifetime = 10 * time.Minute
+
+// pairingPollInterval is how often a device may poll for approval
+const pairingPollInterval = 5 * time.Second
+
+const deviceCodeSize = 32
+
+// userCodeAlphabet has no vowels, to avoid spelling words, and no easily confused characters
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const userCodeLength = 8
+
+// Limits on starting pairings per address and approving them per user, against flooding and guessing user codes
+const (
+	pairingStartLimit   = 10
+	pairingApproveLimit = 10
+	pairingLimitWindow  = time.Minute
+)
+
+// Errors reported to polling devices, as in the OAuth device authorization grant
+const (
+	pairingPending  = "authorization_pending"
+	pairingSlowDown = "slow_down"
+	pairingExpired  = "expired_token"
+)
+
+type pairingRequest struct {
+	// DeviceCode is never stored, requests are keyed by its hash instead
+	DeviceCode string `datastore:"-"`
+	// UserCode is shown by the device for its user to enter, and stored without its separator
+	UserCode   string
+	DeviceName string `datastore:",noindex"`
+	UserAgent  string `datastore:",noindex"`
+	IP         string `datastore:",noindex"`
+	Created    time.Time
+	Expiry     time.Time
+	LastPolled time.Time
+	// User, UserKey and Email are set once a signed in user approves the request
+	User    string
+	UserKey string
+	Email   string
+}
+
+type pairingStart struct {
+	DeviceCode      string
+	UserCode        string
+	VerificationURI string
+	// ExpiresIn and Interval are in seconds
+	ExpiresIn int
+	Interval  int
+}
+
+type pairingApproval struct {
+	UserCode string
+}
+
+type pairingApproved struct {
+	DeviceName string
+}
+
+type pairingCode struct {
+	DeviceCode string
+}
+
+type pairingError struct {
+	Error string
+}
+
+// pairedSession gives a device its session, to send as the session cookie with the CSRF token
+type pairedSession struct {
+	Token     string
+	CSRFToken string
+	Expiry    time.Time
+}
+
+func genUserCode() (string, error) {
+	codeBytes := make([]byte, userCodeLength)
+
+	if _, err := io.ReadFull(rand.Reader, codeBytes); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, userCodeLength)
+
+	for i, b := range codeBytes {
+		// 256 is not a multiple of the alphabet size, but the bias does not help guessing within the rate limits
+		code[i] = userCodeAlphabet[int(b)%len(userCodeAlphabet)]
+	}
+
+	return string(code), nil
+}
+
+// formatUserCode splits a user code in half, to make it easier to read
+func formatUserCode(code string) string {
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// normalizeUserCode accepts user codes typed in lower case, with or without separators
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+
+		return r
+	}, strings.ToUpper(code))
+}
+
+func writePairingError(w http.ResponseWriter, pairingErr string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+
+	if err := json.NewEncoder(w).Encode(&pairingError{
+		Error: pairingErr,
+	}); err != nil {
+		log.Println("Error writing pairing error:", err)
+	}
+}
+
+type pairHandler struct {
+	accessPolicy   *AccessPolicy
+	sessionStore   SessionStore
+	pairingStore   PairingStore
+	startLimiter   *rateLimiter
+	approveLimiter *rateLimiter
+	// trustedProxies is how many proxies in front of the server append to X-Forwarded-For
+	trustedProxies int
+}
+
+func (h *pairHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case pairPath:
+		h.start(w, r)
+	case pairApprovePath:
+		h.approve(w, r)
+	case pairTokenPath:
+		h.poll(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// start creates a pairing request for a headless device
+func (h *pairHandler) start(w http.ResponseWriter, r *http.Request) {
+	device := requestDevice(r)
+
+	if !h.startLimiter.Allow(trustedIP(r, h.trustedProxies)) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	deviceCode, err := randomToken(deviceCodeSize)
+
+	if err != nil {
+		log.Println("Error generating device code:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	userCode, err := genUserCode()
+
+	if err != nil {
+		log.Println("Error generating user code:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+
+	if err := h.pairingStore.Create(r.Context(), &pairingRequest{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		DeviceName: device.Name,
+		UserAgent:  device.UserAgent,
+		IP:         device.IP,
+		Created:    now,
+		Expiry:     now.Add(pairingLifetime),
+	}); err != nil {
+		log.Println("Error creating pairing request:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&pairingStart{
+		DeviceCode:      deviceCode,
+		UserCode:        formatUserCode(userCode),
+		VerificationURI: "https://" + r.Host + "/",
+		ExpiresIn:       int(pairingLifetime / time.Second),
+		Interval:        int(pairingPollInterval / time.Second),
+	}); err != nil {
+		log.Println("Error writing pairing request:", err)
+	}
+}
+
+// approve signs in a pairing request as the user of the current session
+func (h *pairHandler) approve(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if !h.approveLimiter.Allow(session.User) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var approval pairingApproval
+
+	if err := json.NewDecoder(r.Body).Decode(&approval); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	request, err := h.pairingStore.Approve(r.Context(), normalizeUserCode(approval.UserCode), session, time.Now())
+
+	if err == errorPairingNotFound {
+		http.Error(w, "Unknown or expired code", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error approving pairing request:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User", session.User, "approved pairing of", request.IP)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&pairingApproved{
+		DeviceName: request.DeviceName,
+	}); err != nil {
+		log.Println("Error writing pairing approval:", err)
+	}
+}
+
+// poll gives a device its session once its pairing request is approved
+func (h *pairHandler) poll(w http.ResponseWriter, r *http.Request) {
+	var code pairingCode
+
+	if err := json.NewDecoder(r.Body).Decode(&code); err != nil || code.DeviceCode == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+
+	request, err := h.pairingStore.Poll(r.Context(), code.DeviceCode, now)
+
+	if err == errorPairingNotFound {
+		writePairingError(w, pairingExpired)
+		return
+	} else if err != nil {
+		log.Println("Error polling pairing request:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if now.After(request.Expiry) {
+		writePairingError(w, pairingExpired)
+		return
+	}
+
+	if request.User == "" {
+		if now.Sub(request.LastPolled) < pairingPollInterval {
+			writePairingError(w, pairingSlowDown)
+		} else {
+			writePairingError(w, pairingPending)
+		}
+
+		return
+	}
+
+	session, err := genToken(r.Context(), h.sessionStore, request.User, request.UserKey, request.Email, sessionDevice{
+		Name:      request.DeviceName,
+		UserAgent: request.UserAgent,
+		IP:        request.IP,
+	})
+
+	if err != nil {
+		log.Println("Failed to generate token:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User", session.User, "paired a device")
+
+	setSessionCookie(w, session)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&pairedSession{
+		Token:     session.Token,
+		CSRFToken: session.CSRFToken,
+		Expiry:    session.Expiry,
+	}); err != nil {
+		log.Println("Error writing paired session:", err)
+	}
+}
+
+// PairHandler handles signing in headless devices with codes approved by signed in users, under its path and its subpaths
+func PairHandler(accessPolicy *AccessPolicy, sessionStore SessionStore, pairingStore PairingStore, trustedProxies int) (string, http.Handler) {
+	return pairPath, &pairHandler{
+		accessPolicy:   accessPolicy,
+		sessionStore:   sessionStore,
+		pairingStore:   pairingStore,
+		startLimiter:   newRateLimiter(pairingStartLimit, pairingLimitWindow),
+		approveLimiter: newRateLimiter(pairingApproveLimit, pairingLimitWindow),
+		trustedProxies: trustedProxies,
+	}
+}
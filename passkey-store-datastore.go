@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastorePasskeyStore struct {
+	c *datastore.Client
+}
+
+func newDatastorePasskeyStore(c *datastore.Client) *datastorePasskeyStore {
+	return &datastorePasskeyStore{
+		c: c,
+	}
+}
+
+func passkeyKey(id string) *datastore.Key {
+	return datastore.NameKey(passkeyKind, id, nil)
+}
+
+func passkeyCeremonyKey(id string) *datastore.Key {
+	return datastore.NameKey(passkeyCeremonyKind, id, nil)
+}
+
+func (s *datastorePasskeyStore) Create(ctx context.Context, key *passkey) error {
+	_, err := s.c.Put(ctx, passkeyKey(key.ID), key)
+
+	return err
+}
+
+func (s *datastorePasskeyStore) Lookup(ctx context.Context, id string) (*passkey, error) {
+	var key passkey
+
+	if err := s.c.Get(ctx, passkeyKey(id), &key); err == datastore.ErrNoSuchEntity {
+		return nil, errorPasskeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (s *datastorePasskeyStore) List(ctx context.Context, user string) ([]*passkey, error) {
+	var keys []*passkey
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(passkeyKind).Filter("User =", user), &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (s *datastorePasskeyStore) Update(ctx context.Context, key *passkey) error {
+	datastoreKey := passkeyKey(key.ID)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var storedKey passkey
+
+		if err := tx.Get(datastoreKey, &storedKey); err == datastore.ErrNoSuchEntity {
+			return errorPasskeyNotFound
+		} else if err != nil {
+			return err
+		}
+
+		_, err := tx.Put(datastoreKey, key)
+
+		return err
+	})
+
+	return err
+}
+
+func (s *datastorePasskeyStore) Delete(ctx context.Context, user string, id string) error {
+	datastoreKey := passkeyKey(id)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var key passkey
+
+		if err := tx.Get(datastoreKey, &key); err == datastore.ErrNoSuchEntity {
+			return errorPasskeyNotFound
+		} else if err != nil {
+			return err
+		}
+
+		if key.User != user {
+			return errorPasskeyNotFound
+		}
+
+		return tx.Delete(datastoreKey)
+	})
+
+	return err
+}
+
+func (s *datastorePasskeyStore) Reassign(ctx context.Context, from string, to string) error {
+	var keys []*passkey
+
+	datastoreKeys, err := s.c.GetAll(ctx, datastore.NewQuery(passkeyKind).Filter("User =", from), &keys)
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		key.Handle = key.userHandle()
+		key.User = to
+	}
+
+	return datastoreBatches(len(datastoreKeys), func(start int, end int) error {
+		_, err := s.c.PutMulti(ctx, datastoreKeys[start:end], keys[start:end])
+
+		return err
+	})
+}
+
+func (s *datastorePasskeyStore) SaveCeremony(ctx context.Context, id string, ceremony *passkeyCeremony) error {
+	_, err := s.c.Put(ctx, passkeyCeremonyKey(id), ceremony)
+
+	return err
+}
+
+func (s *datastorePasskeyStore) TakeCeremony(ctx context.Context, id string) (*passkeyCeremony, error) {
+	key := passkeyCeremonyKey(id)
+
+	var ceremony passkeyCeremony
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &ceremony); err == datastore.ErrNoSuchEntity {
+			return errorCeremonyNotFound
+		} else if err != nil {
+			return err
+		}
+
+		return tx.Delete(key)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ceremony, nil
+}
+
+func (s *datastorePasskeyStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	return datastoreDeleteMatching(ctx, s.c, datastore.NewQuery(passkeyCeremonyKind).Filter("Expiry <", now))
+}
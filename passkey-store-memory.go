@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryPasskeyStore keeps passkeys and ceremonies for the lifetime of the process
+type memoryPasskeyStore struct {
+	lock       sync.Mutex
+	passkeys   map[string]passkey
+	ceremonies map[string]passkeyCeremony
+}
+
+func newMemoryPasskeyStore() *memoryPasskeyStore {
+	return &memoryPasskeyStore{
+		passkeys:   make(map[string]passkey),
+		ceremonies: make(map[string]passkeyCeremony),
+	}
+}
+
+func (s *memoryPasskeyStore) Create(ctx context.Context, key *passkey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.passkeys[key.ID] = *key
+
+	return nil
+}
+
+func (s *memoryPasskeyStore) Lookup(ctx context.Context, id string) (*passkey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, found := s.passkeys[id]
+
+	if !found {
+		return nil, errorPasskeyNotFound
+	}
+
+	return &key, nil
+}
+
+func (s *memoryPasskeyStore) List(ctx context.Context, user string) ([]*passkey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	keys := []*passkey{}
+
+	for _, key := range s.passkeys {
+		if key.User == user {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *memoryPasskeyStore) Update(ctx context.Context, key *passkey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.passkeys[key.ID]; !found {
+		return errorPasskeyNotFound
+	}
+
+	s.passkeys[key.ID] = *key
+
+	return nil
+}
+
+func (s *memoryPasskeyStore) Delete(ctx context.Context, user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key, found := s.passkeys[id]; !found || key.User != user {
+		return errorPasskeyNotFound
+	}
+
+	delete(s.passkeys, id)
+
+	return nil
+}
+
+func (s *memoryPasskeyStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, key := range s.passkeys {
+		if key.User == from {
+			key.Handle = key.userHandle()
+			key.User = to
+			s.passkeys[id] = key
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryPasskeyStore) SaveCeremony(ctx context.Context, id string, ceremony *passkeyCeremony) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.ceremonies[id] = *ceremony
+
+	return nil
+}
+
+func (s *memoryPasskeyStore) TakeCeremony(ctx context.Context, id string) (*passkeyCeremony, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ceremony, found := s.ceremonies[id]
+
+	if !found {
+		return nil, errorCeremonyNotFound
+	}
+
+	delete(s.ceremonies, id)
+
+	return &ceremony, nil
+}
+
+func (s *memoryPasskeyStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, ceremony := range s.ceremonies {
+		if ceremony.Expiry.Before(now) {
+			delete(s.ceremonies, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqlitePasskeyStore struct {
+	db *sql.DB
+}
+
+func newSQLitePasskeyStore(db *sql.DB) *sqlitePasskeyStore {
+	return &sqlitePasskeyStore{
+		db: db,
+	}
+}
+
+const sqlitePasskeyColumns = "id, user, email, name, credential, created, last_used, handle, user_key"
+
+func scanSQLitePasskey(row sqliteScanner) (*passkey, error) {
+	var key passkey
+
+	var created, lastUsed int64
+
+	if err := row.Scan(&key.ID, &key.User, &key.Email, &key.Name, &key.Credential, &created, &lastUsed, &key.Handle, &key.UserKey); err != nil {
+		return nil, err
+	}
+
+	key.Created = fromSQLiteTime(created)
+	key.LastUsed = fromSQLiteTime(lastUsed)
+
+	return &key, nil
+}
+
+func (s *sqlitePasskeyStore) Create(ctx context.Context, key *passkey) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO passkeys ("+sqlitePasskeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		key.ID, key.User, key.Email, key.Name, key.Credential, sqliteTime(key.Created), sqliteTime(key.LastUsed), key.Handle, key.UserKey)
+
+	return err
+}
+
+func (s *sqlitePasskeyStore) Lookup(ctx context.Context, id string) (*passkey, error) {
+	key, err := scanSQLitePasskey(s.db.QueryRowContext(ctx, "SELECT "+sqlitePasskeyColumns+" FROM passkeys WHERE id = ?", id))
+
+	if err == sql.ErrNoRows {
+		return nil, errorPasskeyNotFound
+	}
+
+	return key, err
+}
+
+func (s *sqlitePasskeyStore) List(ctx context.Context, user string) ([]*passkey, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqlitePasskeyColumns+" FROM passkeys WHERE user = ?", user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*passkey{}
+
+	for rows.Next() {
+		key, err := scanSQLitePasskey(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// sqliteRequirePasskeyUpdate reports errorPasskeyNotFound when nothing was changed
+func sqliteRequirePasskeyUpdate(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if err := sqliteRequireUpdate(result); err == errorTokenNotFound {
+		return errorPasskeyNotFound
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqlitePasskeyStore) Update(ctx context.Context, key *passkey) error {
+	return sqliteRequirePasskeyUpdate(s.db.ExecContext(ctx, "UPDATE passkeys SET name = ?, credential = ?, last_used = ? WHERE id = ?",
+		key.Name, key.Credential, sqliteTime(key.LastUsed), key.ID))
+}
+
+func (s *sqlitePasskeyStore) Delete(ctx context.Context, user string, id string) error {
+	return sqliteRequirePasskeyUpdate(s.db.ExecContext(ctx, "DELETE FROM passkeys WHERE user = ? AND id = ?", user, id))
+}
+
+func (s *sqlitePasskeyStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE passkeys SET handle = CASE handle WHEN '' THEN user ELSE handle END, user = ? WHERE user = ?", to, from)
+
+	return err
+}
+
+func (s *sqlitePasskeyStore) SaveCeremony(ctx context.Context, id string, ceremony *passkeyCeremony) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO passkey_ceremonies (id, user, data, expiry) VALUES (?, ?, ?, ?)",
+		id, ceremony.User, ceremony.Data, sqliteTime(ceremony.Expiry))
+
+	return err
+}
+
+func (s *sqlitePasskeyStore) TakeCeremony(ctx context.Context, id string) (*passkeyCeremony, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var ceremony passkeyCeremony
+
+	var expiry int64
+
+	if err := tx.QueryRowContext(ctx, "SELECT user, data, expiry FROM passkey_ceremonies WHERE id = ?", id).Scan(&ceremony.User, &ceremony.Data, &expiry); err == sql.ErrNoRows {
+		return nil, errorCeremonyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	ceremony.Expiry = fromSQLiteTime(expiry)
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM passkey_ceremonies WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+
+	return &ceremony, tx.Commit()
+}
+
+func (s *sqlitePasskeyStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM passkey_ceremonies WHERE expiry < ?", sqliteTime(now))
+
+	return err
+}
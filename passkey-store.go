@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errorPasskeyNotFound = errors.New("Passkey not found")
+
+var errorCeremonyNotFound = errors.New("Passkey ceremony not found")
+
+// PasskeyStore persists WebAuthn credentials, and the challenges of ceremonies in progress
+type PasskeyStore interface {
+	Create(ctx context.Context, key *passkey) error
+	// Lookup finds a passkey by its credential ID, returning errorPasskeyNotFound if there is none
+	Lookup(ctx context.Context, id string) (*passkey, error)
+	// List finds all of a user's passkeys
+	List(ctx context.Context, user string) ([]*passkey, error)
+	// Update stores the credential and last use of a passkey after it is used to log in
+	Update(ctx context.Context, key *passkey) error
+	// Delete removes one of a user's passkeys, returning errorPasskeyNotFound if they have no such passkey
+	Delete(ctx context.Context, user string, id string) error
+	// Reassign moves every passkey of a user to another user ID, keeping their user handles
+	Reassign(ctx context.Context, from string, to string) error
+	SaveCeremony(ctx context.Context, id string, ceremony *passkeyCeremony) error
+	// TakeCeremony finds and removes a ceremony, so that each challenge is answered at most once.
+	// Returns errorCeremonyNotFound if there is no such ceremony.
+	TakeCeremony(ctx context.Context, id string) (*passkeyCeremony, error)
+	// DeleteExpired removes every ceremony which expired before now
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const passkeyKind = "Passkey"
+
+const passkeyCeremonyKind = "PasskeyCeremony"
+
+const passkeysPath = "/passkeys"
+
+const passkeyRegisterBeginPath = passkeysPath + "/register/begin"
+
+const passkeyRegisterFinishPath = passkeysPath + "/register/finish"
+
+const passkeyLoginBeginPath = passkeysPath + "/login/begin"
+
+const passkeyLoginFinishPath = passkeysPath + "/login/finish"
+
+const passkeyCeremonyCookieName = "passkey-ceremony"
+
+// passkeyCeremonyLifetime is how long a user has to answer a challenge
+const passkeyCeremonyLifetime = 5 * time.Minute
+
+const passkeyCeremonyIDSize = 32
+
+// Limits on starting passkey logins per address, as each stores a ceremony until the cleanup removes it
+const (
+	passkeyLoginLimit  = 10
+	passkeyLimitWindow = time.Minute
+)
+
+const relyingPartyName = "Web Clipboard"
+
+var errorCeremonyWrongUser = errors.New("Passkey ceremony started by another user")
+
+var errorCeremonyExpired = errors.New("Passkey ceremony expired")
+
+var errorPasskeyCloned = errors.New("Passkey may have been cloned")
+
+// passkey is a WebAuthn credential which logs in as the user who registered it
+type passkey struct {
+	// ID is the credential ID, base64url encoded
+	ID    string
+	User  string
+	Email string
+	Name  string
+	// Credential is the JSON encoded webauthn.Credential
+	Credential []byte `datastore:",noindex"`
+	Created    time.Time
+	LastUsed   time.Time
+	// Handle is the user handle the passkey was registered with, if it differs from User after the user ID was migrated
+	Handle string
+	// UserKey identifies the user to the access policy, and is empty for passkeys from before it was recorded
+	UserKey string
+}
+
+// userHandle is the user handle the authenticator returns for the passkey
+func (key *passkey) userHandle() string {
+	if key.Handle == "" {
+		return key.User
+	}
+
+	return key.Handle
+}
+
+// passkeyCeremony holds the challenge of a registration or login until it is answered
+type passkeyCeremony struct {
+	// User is empty for logins, where the user is not known until the challenge is answered
+	User string
+	// Data is the JSON encoded webauthn.SessionData
+	Data   []byte `datastore:",noindex"`
+	Expiry time.Time
+}
+
+// passkeyInfo describes a passkey to its user
+type passkeyInfo struct {
+	ID       string
+	Name     string
+	Created  time.Time
+	LastUsed time.Time `json:",omitempty"`
+}
+
+// webauthnUser presents a user and their passkeys to the WebAuthn library, with the user ID hash as the user handle
+type webauthnUser struct {
+	handle      string
+	email       string
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	return []byte(u.handle)
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.email
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.email
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func newPasskeyInfo(key *passkey) passkeyInfo {
+	return passkeyInfo{
+		ID:       key.ID,
+		Name:     key.Name,
+		Created:  key.Created,
+		LastUsed: key.LastUsed,
+	}
+}
+
+func passkeyCredentials(keys []*passkey) ([]webauthn.Credential, error) {
+	credentials := make([]webauthn.Credential, len(keys))
+
+	for i, key := range keys {
+		if err := json.Unmarshal(key.Credential, &credentials[i]); err != nil {
+			return nil, fmt.Errorf("decoding passkey %s: %v", key.ID, err)
+		}
+	}
+
+	return credentials, nil
+}
+
+func loadWebAuthn() (*webauthn.WebAuthn, error) {
+	rpID, rpIDDeclared := os.LookupEnv("WEBAUTHN_RP_ID")
+
+	if !rpIDDeclared {
+		log.Println("WebAuthn relying party ID not declared, passkeys are disabled")
+		return nil, nil
+	}
+
+	origins := []string{"https://" + rpID}
+
+	if originsText, originsDeclared := os.LookupEnv("WEBAUTHN_ORIGINS"); originsDeclared {
+		origins = strings.Split(originsText, ",")
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: relyingPartyName,
+		RPOrigins:     origins,
+	})
+}
+
+type passkeysHandler struct {
+	webAuthn     *webauthn.WebAuthn
+	accessPolicy *AccessPolicy
+	sessionStore SessionStore
+	passkeyStore PasskeyStore
+	loginLimiter *rateLimiter
+	// trustedProxies is how many proxies in front of the server append to X-Forwarded-For
+	trustedProxies int
+}
+
+func (h *passkeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case passkeyRegisterBeginPath, passkeyRegisterFinishPath, passkeyLoginBeginPath, passkeyLoginFinishPath:
+		if r.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch r.URL.Path {
+		case passkeyRegisterBeginPath:
+			h.beginRegistration(w, r)
+		case passkeyRegisterFinishPath:
+			h.finishRegistration(w, r)
+		case passkeyLoginBeginPath:
+			h.beginLogin(w, r)
+		case passkeyLoginFinishPath:
+			h.finishLogin(w, r)
+		}
+	default:
+		h.manage(w, r)
+	}
+}
+
+// startCeremony stores a ceremony's challenge, keyed by a cookie given to the client
+func (h *passkeysHandler) startCeremony(ctx context.Context, w http.ResponseWriter, user string, data *webauthn.SessionData) error {
+	id, err := randomToken(passkeyCeremonyIDSize)
+
+	if err != nil {
+		return err
+	}
+
+	dataJSON, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	if err := h.passkeyStore.SaveCeremony(ctx, id, &passkeyCeremony{
+		User:   user,
+		Data:   dataJSON,
+		Expiry: time.Now().Add(passkeyCeremonyLifetime),
+	}); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCeremonyCookieName,
+		Value:    id,
+		Path:     passkeysPath,
+		MaxAge:   int(passkeyCeremonyLifetime / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// finishCeremony takes the challenge of the client's ceremony, which must have been started by the user
+func (h *passkeysHandler) finishCeremony(ctx context.Context, w http.ResponseWriter, r *http.Request, user string) (*webauthn.SessionData, error) {
+	cookie, err := r.Cookie(passkeyCeremonyCookieName)
+
+	if err != nil {
+		return nil, errorCeremonyNotFound
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passkeyCeremonyCookieName,
+		Value:    "",
+		Path:     passkeysPath,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	ceremony, err := h.passkeyStore.TakeCeremony(ctx, cookie.Value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ceremony.User != user {
+		return nil, errorCeremonyWrongUser
+	}
+
+	if time.Now().After(ceremony.Expiry) {
+		return nil, errorCeremonyExpired
+	}
+
+	var data webauthn.SessionData
+
+	if err := json.Unmarshal(ceremony.Data, &data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (h *passkeysHandler) sessionUser(ctx context.Context, session *sessionCookie) (*webauthnUser, error) {
+	keys, err := h.passkeyStore.List(ctx, session.User)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := passkeyCredentials(keys)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthnUser{
+		handle:      session.User,
+		email:       session.Email,
+		credentials: credentials,
+	}, nil
+}
+
+// beginRegistration challenges the signed in user to create a passkey
+func (h *passkeysHandler) beginRegistration(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	user, err := h.sessionUser(r.Context(), session)
+
+	if err != nil {
+		log.Println("Error finding passkeys:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Passkeys are discoverable credentials, so that logging in needs no user name
+	creation, data, err := h.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+
+	if err != nil {
+		log.Println("Error beginning passkey registration:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.startCeremony(r.Context(), w, session.User, data); err != nil {
+		log.Println("Error storing passkey ceremony:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(creation); err != nil {
+		log.Println("Error writing passkey registration:", err)
+	}
+}
+
+// finishRegistration stores the passkey created in answer to the challenge, named by the name query parameter
+func (h *passkeysHandler) finishRegistration(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	data, err := h.finishCeremony(r.Context(), w, r, session.User)
+
+	if err != nil {
+		log.Println("Invalid passkey ceremony:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.sessionUser(r.Context(), session)
+
+	if err != nil {
+		log.Println("Error finding passkeys:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := h.webAuthn.FinishRegistration(user, *data, r)
+
+	if err != nil {
+		log.Println("Invalid passkey registration:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+
+	if err != nil {
+		log.Println("Error encoding passkey:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := truncateText(r.URL.Query().Get("name"), maxDeviceNameLength)
+
+	key := &passkey{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		User:       session.User,
+		UserKey:    session.UserKey,
+		Email:      session.Email,
+		Name:       name,
+		Credential: credentialJSON,
+		Created:    time.Now(),
+	}
+
+	if err := h.passkeyStore.Create(r.Context(), key); err != nil {
+		log.Println("Error storing passkey:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User", session.User, "registered passkey", key.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(newPasskeyInfo(key)); err != nil {
+		log.Println("Error writing passkey:", err)
+	}
+}
+
+// beginLogin challenges a client to log in with any passkey
+func (h *passkeysHandler) beginLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.loginLimiter.Allow(trustedIP(r, h.trustedProxies)) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	assertion, data, err := h.webAuthn.BeginDiscoverableLogin()
+
+	if err != nil {
+		log.Println("Error beginning passkey login:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.startCeremony(r.Context(), w, "", data); err != nil {
+		log.Println("Error storing passkey ceremony:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(assertion); err != nil {
+		log.Println("Error writing passkey login:", err)
+	}
+}
+
+// finishLogin starts a session for the user of the passkey which answered the challenge
+func (h *passkeysHandler) finishLogin(w http.ResponseWriter, r *http.Request) {
+	data, err := h.finishCeremony(r.Context(), w, r, "")
+
+	if err != nil {
+		log.Println("Invalid passkey ceremony:", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var key *passkey
+
+	_, credential, err := h.webAuthn.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+
+		key, err = h.passkeyStore.Lookup(r.Context(), base64.RawURLEncoding.EncodeToString(rawID))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key.userHandle() != string(userHandle) {
+			return nil, errorPasskeyNotFound
+		}
+
+		credentials, err := passkeyCredentials([]*passkey{key})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &webauthnUser{
+			handle:      key.userHandle(),
+			email:       key.Email,
+			credentials: credentials,
+		}, nil
+	}, *data, r)
+
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = errorPasskeyCloned
+	}
+
+	if err != nil {
+		log.Println("Invalid passkey login:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := h.accessPolicy.Check(key.Email, key.UserKey); err != nil {
+		log.Println("Refused user", key.User, "with passkey:", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	credentialJSON, err := json.Marshal(credential)
+
+	if err != nil {
+		log.Println("Error encoding passkey:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	key.Credential = credentialJSON
+	key.LastUsed = time.Now()
+
+	// The sign count must be stored for clones to be detected
+	if err := h.passkeyStore.Update(r.Context(), key); err != nil {
+		log.Println("Error updating passkey:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := genToken(r.Context(), h.sessionStore, key.User, key.UserKey, verifiedEmail(key.Email, key.UserKey), requestDevice(r))
+
+	if err != nil {
+		log.Println("Failed to generate token:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	log.Println("User", key.User, "logged in with passkey", key.ID)
+
+	setSessionCookie(w, session)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&sessionLogin{
+		Email:     session.Email,
+		Expiry:    session.Expiry,
+		CSRFToken: session.CSRFToken,
+	}); err != nil {
+		log.Println("Error writing session:", err)
+	}
+}
+
+// manage lists and deletes the passkeys of the signed in user
+func (h *passkeysHandler) manage(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, passkeysPath), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		keys, err := h.passkeyStore.List(r.Context(), session.User)
+
+		if err != nil {
+			log.Println("Error listing passkeys:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		infos := []passkeyInfo{}
+
+		for _, key := range keys {
+			infos = append(infos, newPasskeyInfo(key))
+		}
+
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Created.After(infos[j].Created)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(infos); err != nil {
+			log.Println("Error writing passkeys:", err)
+		}
+	case r.Method == "DELETE" && id != "":
+		if err := h.passkeyStore.Delete(r.Context(), session.User, id); err == errorPasskeyNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error deleting passkey:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, "Deleted")
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// PasskeysHandler handles registering passkeys, logging in with them, and listing and deleting them, under its path and its subpaths
+func PasskeysHandler(webAuthn *webauthn.WebAuthn, accessPolicy *AccessPolicy, sessionStore SessionStore, passkeyStore PasskeyStore, trustedProxies int) (string, http.Handler) {
+	return passkeysPath, &passkeysHandler{
+		webAuthn:       webAuthn,
+		accessPolicy:   accessPolicy,
+		sessionStore:   sessionStore,
+		passkeyStore:   passkeyStore,
+		loginLimiter:   newRateLimiter(passkeyLoginLimit, passkeyLimitWindow),
+		trustedProxies: trustedProxies,
+	}
+}
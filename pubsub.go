@@ -4,26 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
 )
 
-func createTopic(ctx context.Context, client *pubsub.Client, userIDHash string) *pubsub.Topic {
-	topicName := fmt.Sprint("notifications-", userIDHash)
-
-	topic, err := client.CreateTopic(ctx, topicName)
-
-	if err != nil {
-		topic = client.Topic(topicName)
-	}
-
-	return topic
+func topicName(userIDHash string) string {
+	return fmt.Sprint("notifications-", userIDHash)
 }
 
-func createSubscription(ctx context.Context, client *pubsub.Client, userIDHash string) (sub *pubsub.Subscription, err error) {
-	topic := createTopic(ctx, client, userIDHash)
-
+func createSubscription(ctx context.Context, client *pubsub.Client, topic *pubsub.Topic, userIDHash string) (sub *pubsub.Subscription, err error) {
 	subName := fmt.Sprintf("listen-%s-%016x", userIDHash, time.Now().UnixNano())
 
 	sub, err = client.CreateSubscription(ctx, subName, pubsub.SubscriptionConfig{Topic: topic})
@@ -42,3 +33,125 @@ func createSubscription(ctx context.Context, client *pubsub.Client, userIDHash s
 
 	return
 }
+
+// pubsubBus is a notification bus backed by Google Cloud Pub/Sub
+type pubsubBus struct {
+	client *pubsub.Client
+	lock   sync.Mutex
+	// topics are kept once found, as each starts its own goroutines to batch what is published to it
+	topics map[string]*pubsub.Topic
+}
+
+type pubsubSubscription struct {
+	sub *pubsub.Subscription
+}
+
+func newPubsubBus(client *pubsub.Client) *pubsubBus {
+	return &pubsubBus{
+		client: client,
+		topics: make(map[string]*pubsub.Topic),
+	}
+}
+
+// topic finds a user's topic, creating it if create is set, or giving nil if it does not exist
+func (b *pubsubBus) topic(ctx context.Context, userIDHash string, create bool) (*pubsub.Topic, error) {
+	b.lock.Lock()
+	topic, found := b.topics[userIDHash]
+	b.lock.Unlock()
+
+	if found {
+		return topic, nil
+	}
+
+	name := topicName(userIDHash)
+
+	topic = b.client.Topic(name)
+
+	exists, err := topic.Exists(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if !create {
+			return nil, nil
+		}
+
+		topic, err = b.client.CreateTopic(ctx, name)
+
+		if err != nil {
+			// Another instance may have created it first
+			topic = b.client.Topic(name)
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if cached, found := b.topics[userIDHash]; found {
+		return cached, nil
+	}
+
+	b.topics[userIDHash] = topic
+
+	return topic, nil
+}
+
+// Publish sends data to the user's topic, where there is nothing to do if nobody has ever subscribed to it
+func (b *pubsubBus) Publish(ctx context.Context, userIDHash string, data []byte) error {
+	topic, err := b.topic(ctx, userIDHash, false)
+
+	if err != nil || topic == nil {
+		return err
+	}
+
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: data}).Get(ctx)
+
+	return err
+}
+
+func (b *pubsubBus) Subscribe(ctx context.Context, userIDHash string) (NotificationSubscription, error) {
+	topic, err := b.topic(ctx, userIDHash, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := createSubscription(ctx, b.client, topic, userIDHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &pubsubSubscription{
+		sub: sub,
+	}, nil
+}
+
+func (b *pubsubBus) DeleteTopic(ctx context.Context, userIDHash string) error {
+	b.lock.Lock()
+
+	if cached, found := b.topics[userIDHash]; found {
+		cached.Stop()
+		delete(b.topics, userIDHash)
+	}
+
+	b.lock.Unlock()
+
+	topic := b.client.Topic(topicName(userIDHash))
+
+	if exists, err := topic.Exists(ctx); err != nil || !exists {
+		return err
+	}
+
+	return topic.Delete(ctx)
+}
+
+func (s *pubsubSubscription) Receive(ctx context.Context, f func(data []byte)) error {
+	return s.sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		defer m.Ack()
+
+		f(m.Data)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const usagePath = "/usage"
+
+const (
+	defaultQuotaMaxBytes    = 1 << 30
+	defaultQuotaMaxItems    = 10000
+	defaultQuotaMaxItemSize = 100 << 20
+)
+
+// usageReport tells a user what they store and what their quota allows, where a limit of 0 is no limit
+type usageReport struct {
+	Bytes       int64
+	Items       int
+	MaxBytes    int64
+	MaxItems    int
+	MaxItemSize int64
+}
+
+func loadQuotaLimit(name string, description string, defaultLimit int64) (int64, error) {
+	limitText, limitDeclared := os.LookupEnv(name)
+
+	if !limitDeclared {
+		log.Println(description, "not declared, defaulting to", defaultLimit)
+		return defaultLimit, nil
+	}
+
+	return strconv.ParseInt(limitText, 10, 64)
+}
+
+// loadQuotaDefaults reads the quota of users without overrides, where a limit of 0 is no limit
+func loadQuotaDefaults() (quotaLimits, error) {
+	var defaults quotaLimits
+
+	var err error
+
+	defaults.MaxBytes, err = loadQuotaLimit("QUOTA_MAX_BYTES", "Quota bytes", defaultQuotaMaxBytes)
+
+	if err != nil {
+		return defaults, err
+	}
+
+	maxItems, err := loadQuotaLimit("QUOTA_MAX_ITEMS", "Quota items", defaultQuotaMaxItems)
+
+	if err != nil {
+		return defaults, err
+	}
+
+	defaults.MaxItems = int(maxItems)
+
+	defaults.MaxItemSize, err = loadQuotaLimit("QUOTA_MAX_ITEM_SIZE", "Quota item size", defaultQuotaMaxItemSize)
+
+	return defaults, err
+}
+
+type usageHandler struct {
+	quotaDefaults    quotaLimits
+	accessPolicy     *AccessPolicy
+	sessionStore     SessionStore
+	accessTokenStore AccessTokenStore
+	usageStore       UsageStore
+}
+
+func (h *usageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeRead)
+
+		if err != nil {
+			log.Println("Invalid session:", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		usage, err := h.usageStore.Get(r.Context(), auth.User)
+
+		if err != nil {
+			log.Println("Error getting usage:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		limits := usage.limits(h.quotaDefaults)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(&usageReport{
+			Bytes:       usage.Bytes,
+			Items:       usage.Items,
+			MaxBytes:    limits.MaxBytes,
+			MaxItems:    limits.MaxItems,
+			MaxItemSize: limits.MaxItemSize,
+		}); err != nil {
+			log.Println("Error writing usage:", err)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// UsageHandler handles reporting what the user stores against their quota
+func UsageHandler(quotaDefaults quotaLimits, accessPolicy *AccessPolicy, sessionStore SessionStore, accessTokenStore AccessTokenStore, usageStore UsageStore) (string, http.Handler) {
+	return usagePath, &usageHandler{
+		quotaDefaults:    quotaDefaults,
+		accessPolicy:     accessPolicy,
+		sessionStore:     sessionStore,
+		accessTokenStore: accessTokenStore,
+		usageStore:       usageStore,
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each key a number of events per fixed window, forgetting keys once their window has passed
+type rateLimiter struct {
+	lock      sync.Mutex
+	limit     int
+	window    time.Duration
+	windows   map[string]*rateWindow
+	lastPrune time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// Allow records an event for the key, returning whether it is within the limit
+func (l *rateLimiter) Allow(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastPrune) > l.window {
+		for windowKey, window := range l.windows {
+			if now.Sub(window.start) > l.window {
+				delete(l.windows, windowKey)
+			}
+		}
+
+		l.lastPrune = now
+	}
+
+	window, found := l.windows[key]
+
+	if !found || now.Sub(window.start) > l.window {
+		window = &rateWindow{
+			start: now,
+		}
+
+		l.windows[key] = window
+	}
+
+	window.count++
+
+	return window.count <= l.limit
+}
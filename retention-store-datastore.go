@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreRetentionStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreRetentionStore(c *datastore.Client) *datastoreRetentionStore {
+	return &datastoreRetentionStore{
+		c: c,
+	}
+}
+
+func retentionSettingsKey(user string) *datastore.Key {
+	return datastore.NameKey(retentionSettingsKind, user, nil)
+}
+
+func (s *datastoreRetentionStore) Get(ctx context.Context, user string) (*retentionSettings, error) {
+	var settings retentionSettings
+
+	if err := s.c.Get(ctx, retentionSettingsKey(user), &settings); err == datastore.ErrNoSuchEntity {
+		return &retentionSettings{User: user}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func (s *datastoreRetentionStore) Put(ctx context.Context, settings *retentionSettings) error {
+	_, err := s.c.Put(ctx, retentionSettingsKey(settings.User), settings)
+
+	return err
+}
+
+func (s *datastoreRetentionStore) List(ctx context.Context) ([]*retentionSettings, error) {
+	list := []*retentionSettings{}
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(retentionSettingsKind), &list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (s *datastoreRetentionStore) Reassign(ctx context.Context, from string, to string) error {
+	fromKey := retentionSettingsKey(from)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var settings retentionSettings
+
+		if err := tx.Get(fromKey, &settings); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		settings.User = to
+
+		if _, err := tx.Put(retentionSettingsKey(to), &settings); err != nil {
+			return err
+		}
+
+		return tx.Delete(fromKey)
+	})
+
+	return err
+}
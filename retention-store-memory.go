@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryRetentionStore keeps retention settings for the lifetime of the process
+type memoryRetentionStore struct {
+	lock     sync.Mutex
+	settings map[string]retentionSettings
+}
+
+func newMemoryRetentionStore() *memoryRetentionStore {
+	return &memoryRetentionStore{
+		settings: make(map[string]retentionSettings),
+	}
+}
+
+func (s *memoryRetentionStore) Get(ctx context.Context, user string) (*retentionSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	settings, found := s.settings[user]
+
+	if !found {
+		return &retentionSettings{User: user}, nil
+	}
+
+	return &settings, nil
+}
+
+func (s *memoryRetentionStore) Put(ctx context.Context, settings *retentionSettings) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.settings[settings.User] = *settings
+
+	return nil
+}
+
+func (s *memoryRetentionStore) List(ctx context.Context) ([]*retentionSettings, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := []*retentionSettings{}
+
+	for _, settings := range s.settings {
+		settings := settings
+		list = append(list, &settings)
+	}
+
+	return list, nil
+}
+
+func (s *memoryRetentionStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	settings, found := s.settings[from]
+
+	if !found {
+		return nil
+	}
+
+	delete(s.settings, from)
+
+	settings.User = to
+	s.settings[to] = settings
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+type sqliteRetentionStore struct {
+	db *sql.DB
+}
+
+func newSQLiteRetentionStore(db *sql.DB) *sqliteRetentionStore {
+	return &sqliteRetentionStore{
+		db: db,
+	}
+}
+
+const sqliteRetentionColumns = "user, max_age_days, max_items, updated"
+
+func scanSQLiteRetention(row sqliteScanner) (*retentionSettings, error) {
+	var settings retentionSettings
+
+	var updated int64
+
+	if err := row.Scan(&settings.User, &settings.MaxAgeDays, &settings.MaxItems, &updated); err != nil {
+		return nil, err
+	}
+
+	settings.Updated = fromSQLiteTime(updated)
+
+	return &settings, nil
+}
+
+func (s *sqliteRetentionStore) Get(ctx context.Context, user string) (*retentionSettings, error) {
+	settings, err := scanSQLiteRetention(s.db.QueryRowContext(ctx, "SELECT "+sqliteRetentionColumns+" FROM retention_settings WHERE user = ?", user))
+
+	if err == sql.ErrNoRows {
+		return &retentionSettings{User: user}, nil
+	}
+
+	return settings, err
+}
+
+func (s *sqliteRetentionStore) Put(ctx context.Context, settings *retentionSettings) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO retention_settings ("+sqliteRetentionColumns+") VALUES (?, ?, ?, ?)",
+		settings.User, settings.MaxAgeDays, settings.MaxItems, sqliteTime(settings.Updated))
+
+	return err
+}
+
+func (s *sqliteRetentionStore) List(ctx context.Context) ([]*retentionSettings, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteRetentionColumns+" FROM retention_settings")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	list := []*retentionSettings{}
+
+	for rows.Next() {
+		settings, err := scanSQLiteRetention(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, settings)
+	}
+
+	return list, rows.Err()
+}
+
+func (s *sqliteRetentionStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE OR REPLACE retention_settings SET user = ? WHERE user = ?", to, from)
+
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const retentionSettingsKind = "RetentionSettings"
+
+// retentionSettings limit how long a user's items are kept, where 0 is no limit
+type retentionSettings struct {
+	User       string
+	MaxAgeDays int
+	MaxItems   int
+	Updated    time.Time
+}
+
+// RetentionStore persists users' retention settings, keyed by user
+type RetentionStore interface {
+	// Get finds a user's settings, returning settings without limits if they have none
+	Get(ctx context.Context, user string) (*retentionSettings, error)
+	Put(ctx context.Context, settings *retentionSettings) error
+	// List finds the settings of every user who has any
+	List(ctx context.Context) ([]*retentionSettings, error)
+	// Reassign moves a user's settings to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const retentionPath = "/retention"
+
+const retentionSweepPath = "/cleanup/items"
+
+// maxRetentionItems bounds the item limit users may set, as larger limits are the same as none
+const maxRetentionItems = 1000000
+
+// retentionRequest sets a user's retention settings, where 0 is no limit
+type retentionRequest struct {
+	MaxAgeDays int
+	MaxItems   int
+}
+
+func validateRetentionRequest(request *retentionRequest) error {
+	if request.MaxAgeDays < 0 || request.MaxItems < 0 {
+		return errors.New("Retention limits cannot be negative")
+	}
+
+	if request.MaxItems > maxRetentionItems {
+		return fmt.Errorf("Retention item limits can be at most %d", maxRetentionItems)
+	}
+
+	return nil
+}
+
+// retainedIDs finds the IDs of a user's items outside their retention settings
+func retainedIDs(ctx context.Context, itemStore ItemStore, settings *retentionSettings, now time.Time) ([]string, error) {
+	found := make(map[string]bool)
+
+	ids := []string{}
+
+	var queries []itemQuery
+
+	if settings.MaxAgeDays > 0 {
+		queries = append(queries, itemQuery{
+			Before: itemIDAt(now.AddDate(0, 0, -settings.MaxAgeDays)),
+		})
+	}
+
+	if settings.MaxItems > 0 {
+		queries = append(queries, itemQuery{
+			Offset: settings.MaxItems,
+		})
+	}
+
+	for _, query := range queries {
+		items, err := itemStore.List(ctx, settings.User, query)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			if !found[item.ID] {
+				found[item.ID] = true
+				ids = append(ids, item.ID)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// sweepItems deletes items which have expired or fall outside their user's retention settings, telling the users' devices
+func sweepItems(ctx context.Context, notificationBus NotificationBus, blobStore BlobStore, stores *Stores) error {
+	now := time.Now()
+
+	expired, err := stores.Items.Expired(ctx, now)
+
+	if err != nil {
+		return err
+	}
+
+	userIDs := make(map[string][]string)
+
+	for _, item := range expired {
+		userIDs[item.User] = append(userIDs[item.User], item.ID)
+	}
+
+	allSettings, err := stores.Retention.List(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// One user's items failing to be swept should not keep everyone else's
+	failedUsers := 0
+
+	for _, settings := range allSettings {
+		ids, err := retainedIDs(ctx, stores.Items, settings, now)
+
+		if err != nil {
+			log.Println("Error finding retained items of user", settings.User+":", err)
+			failedUsers++
+			continue
+		}
+
+		userIDs[settings.User] = append(userIDs[settings.User], ids...)
+	}
+
+	for user, ids := range userIDs {
+		// An expired item may also be outside the retention settings, and is skipped once deleted
+		deleted, err := deleteItems(ctx, notificationBus, blobStore, stores.Items, stores.Usage, stores.Shares, user, ids)
+
+		if len(deleted) > 0 {
+			log.Println("Deleted", len(deleted), "items of user", user)
+		}
+
+		if err != nil {
+			log.Println("Error deleting items of user", user+":", err)
+			failedUsers++
+		}
+	}
+
+	if failedUsers > 0 {
+		return fmt.Errorf("failed to sweep the items of %d users", failedUsers)
+	}
+
+	return nil
+}
+
+type retentionHandler struct {
+	accessPolicy   *AccessPolicy
+	sessionStore   SessionStore
+	retentionStore RetentionStore
+}
+
+func (h *retentionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Retention settings are only managed from sessions, as an access token could otherwise delete items without the delete scope
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var settings *retentionSettings
+
+	switch r.Method {
+	case "GET":
+		settings, err = h.retentionStore.Get(r.Context(), session.User)
+
+		if err != nil {
+			log.Println("Error getting retention settings:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	case "PUT":
+		var request retentionRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if err := validateRetentionRequest(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		settings = &retentionSettings{
+			User:       session.User,
+			MaxAgeDays: request.MaxAgeDays,
+			MaxItems:   request.MaxItems,
+			Updated:    time.Now(),
+		}
+
+		if err := h.retentionStore.Put(r.Context(), settings); err != nil {
+			log.Println("Error storing retention settings:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(&retentionRequest{
+		MaxAgeDays: settings.MaxAgeDays,
+		MaxItems:   settings.MaxItems,
+	}); err != nil {
+		log.Println("Error writing retention settings:", err)
+	}
+}
+
+// RetentionHandler handles getting and setting how long the user's items are kept
+func RetentionHandler(accessPolicy *AccessPolicy, sessionStore SessionStore, retentionStore RetentionStore) (string, http.Handler) {
+	return retentionPath, &retentionHandler{
+		accessPolicy:   accessPolicy,
+		sessionStore:   sessionStore,
+		retentionStore: retentionStore,
+	}
+}
+
+// loadCronToken reads the token that lets schedulers other than App Engine cron run the cleanups, which is empty if none may
+func loadCronToken() string {
+	cronToken, cronTokenDeclared := os.LookupEnv("CRON_TOKEN")
+
+	if !cronTokenDeclared {
+		log.Println("Cron token not declared, only App Engine cron may run cleanups")
+	}
+
+	return cronToken
+}
+
+// cronRequest checks a request came from App Engine cron, whose header App Engine strips from any other request, or carries the cron token
+func cronRequest(r *http.Request, cronToken string) bool {
+	if _, appEngine := os.LookupEnv("GAE_INSTANCE"); appEngine && r.Header.Get("X-Appengine-Cron") == "true" {
+		return true
+	}
+
+	token, found := bearerToken(r)
+
+	return found && cronToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cronToken)) == 1
+}
+
+type retentionSweepHandler struct {
+	notificationBus NotificationBus
+	blobStore       BlobStore
+	stores          *Stores
+	cronToken       string
+}
+
+func (h *retentionSweepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !cronRequest(r, h.cronToken) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := sweepItems(r.Context(), h.notificationBus, h.blobStore, h.stores); err != nil {
+		log.Println("Couldn't sweep items:", err)
+
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "Swept Expired Items")
+}
+
+// RetentionSweepHandler handles deleting expired items and items outside their user's retention settings
+func RetentionSweepHandler(notificationBus NotificationBus, blobStore BlobStore, stores *Stores, cronToken string) (string, http.Handler) {
+	return retentionSweepPath, &retentionSweepHandler{
+		notificationBus: notificationBus,
+		blobStore:       blobStore,
+		stores:          stores,
+		cronToken:       cronToken,
+	}
+}
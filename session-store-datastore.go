@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Datastore limits the number of entities in a single batch operation
+const datastoreBatchSize = 500
+
+type datastoreSessionStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreSessionStore(c *datastore.Client) *datastoreSessionStore {
+	return &datastoreSessionStore{
+		c: c,
+	}
+}
+
+// legacySessionCookie is a session stored before tokens were hashed, under an automatically allocated key
+type legacySessionCookie struct {
+	User      string
+	Email     string
+	Token     string
+	Expiry    time.Time
+	CSRFToken string
+}
+
+func sessionKey(token string) *datastore.Key {
+	return datastore.NameKey(cookieKind, hashToken(token), nil)
+}
+
+func (s *datastoreSessionStore) Lookup(ctx context.Context, token string) (*sessionCookie, error) {
+	var cookie sessionCookie
+
+	err := s.c.Get(ctx, sessionKey(token), &cookie)
+
+	if err == datastore.ErrNoSuchEntity {
+		return s.migrateLegacySession(ctx, token)
+	} else if err != nil {
+		return nil, err
+	}
+
+	cookie.Token = token
+
+	return &cookie, nil
+}
+
+// migrateLegacySession moves a session stored with its raw token to its hashed key
+func (s *datastoreSessionStore) migrateLegacySession(ctx context.Context, token string) (*sessionCookie, error) {
+	query := datastore.NewQuery(cookieKind).Filter("Token =", token).Limit(1)
+
+	it := s.c.Run(ctx, query)
+
+	var legacyCookie legacySessionCookie
+
+	legacyKey, err := it.Next(&legacyCookie)
+
+	if err == iterator.Done {
+		return nil, errorTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := randomToken(sessionIDSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := &sessionCookie{
+		User:      legacyCookie.User,
+		Email:     legacyCookie.Email,
+		Token:     token,
+		Expiry:    legacyCookie.Expiry,
+		CSRFToken: legacyCookie.CSRFToken,
+		ID:        id,
+	}
+
+	if err := s.Create(ctx, cookie); err != nil {
+		return nil, err
+	}
+
+	if err := s.c.Delete(ctx, legacyKey); err != nil {
+		return nil, err
+	}
+
+	return cookie, nil
+}
+
+func (s *datastoreSessionStore) Create(ctx context.Context, cookie *sessionCookie) error {
+	_, err := s.c.Put(ctx, sessionKey(cookie.Token), cookie)
+
+	return err
+}
+
+func (s *datastoreSessionStore) Touch(ctx context.Context, token string, expiry time.Time, lastSeen time.Time) error {
+	key := sessionKey(token)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var cookie sessionCookie
+
+		if err := tx.Get(key, &cookie); err == datastore.ErrNoSuchEntity {
+			return errorTokenNotFound
+		} else if err != nil {
+			return err
+		}
+
+		cookie.Expiry = expiry
+		cookie.LastSeen = lastSeen
+
+		if cookie.ID == "" {
+			// Sessions created before they had IDs get one the next time they are used
+			id, err := randomToken(sessionIDSize)
+
+			if err != nil {
+				return err
+			}
+
+			cookie.ID = id
+		}
+
+		_, err := tx.Put(key, &cookie)
+
+		return err
+	})
+
+	return err
+}
+
+func (s *datastoreSessionStore) List(ctx context.Context, user string) ([]*sessionCookie, error) {
+	var cookies []*sessionCookie
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(cookieKind).Filter("User =", user), &cookies); err != nil {
+		return nil, err
+	}
+
+	return cookies, nil
+}
+
+func (s *datastoreSessionStore) RevokeByID(ctx context.Context, user string, id string) error {
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(cookieKind).Filter("User =", user).Filter("ID =", id).KeysOnly(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return errorTokenNotFound
+	}
+
+	return s.c.DeleteMulti(ctx, keys)
+}
+
+// datastoreBatches calls f with the bounds of each batch of n entities
+func datastoreBatches(n int, f func(start int, end int) error) error {
+	for start := 0; start < n; start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+
+		if end > n {
+			end = n
+		}
+
+		if err := f(start, end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// datastoreDeleteMatching deletes every entity the query finds, in batches
+func datastoreDeleteMatching(ctx context.Context, c *datastore.Client, query *datastore.Query) error {
+	keys, err := c.GetAll(ctx, query.KeysOnly(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+
+		if len(batch) > datastoreBatchSize {
+			batch = batch[:datastoreBatchSize]
+		}
+
+		if err := c.DeleteMulti(ctx, batch); err != nil {
+			return err
+		}
+
+		keys = keys[len(batch):]
+	}
+
+	return nil
+}
+
+func (s *datastoreSessionStore) Revoke(ctx context.Context, token string) error {
+	if err := s.c.Delete(ctx, sessionKey(token)); err != nil {
+		return err
+	}
+
+	// Legacy sessions expire within tokenTimeout, after which this query finds nothing
+	return datastoreDeleteMatching(ctx, s.c, datastore.NewQuery(cookieKind).Filter("Token =", token))
+}
+
+func (s *datastoreSessionStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	// Uses the built-in single property index on Expiry
+	return datastoreDeleteMatching(ctx, s.c, datastore.NewQuery(cookieKind).Filter("Expiry <", now))
+}
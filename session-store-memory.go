@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memorySessionStore keeps sessions for the lifetime of the process, keyed by token hash
+type memorySessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]sessionCookie
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]sessionCookie),
+	}
+}
+
+func (s *memorySessionStore) Lookup(ctx context.Context, token string) (*sessionCookie, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cookie, found := s.sessions[hashToken(token)]
+
+	if !found {
+		return nil, errorTokenNotFound
+	}
+
+	cookie.Token = token
+
+	return &cookie, nil
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, cookie *sessionCookie) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	storedCookie := *cookie
+	storedCookie.Token = ""
+
+	s.sessions[hashToken(cookie.Token)] = storedCookie
+
+	return nil
+}
+
+func (s *memorySessionStore) Touch(ctx context.Context, token string, expiry time.Time, lastSeen time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokenHash := hashToken(token)
+
+	cookie, found := s.sessions[tokenHash]
+
+	if !found {
+		return errorTokenNotFound
+	}
+
+	cookie.Expiry = expiry
+	cookie.LastSeen = lastSeen
+	s.sessions[tokenHash] = cookie
+
+	return nil
+}
+
+func (s *memorySessionStore) Revoke(ctx context.Context, token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, hashToken(token))
+
+	return nil
+}
+
+func (s *memorySessionStore) List(ctx context.Context, user string) ([]*sessionCookie, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cookies := []*sessionCookie{}
+
+	for _, cookie := range s.sessions {
+		if cookie.User == user {
+			cookie := cookie
+			cookies = append(cookies, &cookie)
+		}
+	}
+
+	return cookies, nil
+}
+
+func (s *memorySessionStore) RevokeByID(ctx context.Context, user string, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for tokenHash, cookie := range s.sessions {
+		if cookie.User == user && cookie.ID == id {
+			delete(s.sessions, tokenHash)
+			return nil
+		}
+	}
+
+	return errorTokenNotFound
+}
+
+func (s *memorySessionStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for tokenHash, cookie := range s.sessions {
+		if cookie.Expiry.Before(now) {
+			delete(s.sessions, tokenHash)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+func newSQLiteSessionStore(db *sql.DB) *sqliteSessionStore {
+	return &sqliteSessionStore{
+		db: db,
+	}
+}
+
+const sqliteSessionColumns = "user, user_key, email, expiry, csrf_token, created, id, device_name, user_agent, ip, last_seen"
+
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLiteSession(row sqliteScanner) (*sessionCookie, error) {
+	var cookie sessionCookie
+
+	var expiry, created, lastSeen int64
+
+	if err := row.Scan(&cookie.User, &cookie.UserKey, &cookie.Email, &expiry, &cookie.CSRFToken, &created, &cookie.ID, &cookie.DeviceName, &cookie.UserAgent, &cookie.IP, &lastSeen); err != nil {
+		return nil, err
+	}
+
+	cookie.Expiry = fromSQLiteTime(expiry)
+	cookie.Created = fromSQLiteTime(created)
+	cookie.LastSeen = fromSQLiteTime(lastSeen)
+
+	return &cookie, nil
+}
+
+func (s *sqliteSessionStore) Lookup(ctx context.Context, token string) (*sessionCookie, error) {
+	cookie, err := scanSQLiteSession(s.db.QueryRowContext(ctx, "SELECT "+sqliteSessionColumns+" FROM sessions WHERE token_hash = ?", hashToken(token)))
+
+	if err == sql.ErrNoRows {
+		return nil, errorTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	cookie.Token = token
+
+	return cookie, nil
+}
+
+func (s *sqliteSessionStore) Create(ctx context.Context, cookie *sessionCookie) error {
+	_, err := s.db.ExecContext(ctx, "INSERT INTO sessions (token_hash, "+sqliteSessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		hashToken(cookie.Token), cookie.User, cookie.UserKey, cookie.Email, sqliteTime(cookie.Expiry), cookie.CSRFToken, sqliteTime(cookie.Created), cookie.ID, cookie.DeviceName, cookie.UserAgent, cookie.IP, sqliteTime(cookie.LastSeen))
+
+	return err
+}
+
+func sqliteRequireUpdate(result sql.Result) error {
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return errorTokenNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteSessionStore) Touch(ctx context.Context, token string, expiry time.Time, lastSeen time.Time) error {
+	result, err := s.db.ExecContext(ctx, "UPDATE sessions SET expiry = ?, last_seen = ? WHERE token_hash = ?", sqliteTime(expiry), sqliteTime(lastSeen), hashToken(token))
+
+	if err != nil {
+		return err
+	}
+
+	return sqliteRequireUpdate(result)
+}
+
+func (s *sqliteSessionStore) Revoke(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+
+	return err
+}
+
+func (s *sqliteSessionStore) List(ctx context.Context, user string) ([]*sessionCookie, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteSessionColumns+" FROM sessions WHERE user = ?", user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	cookies := []*sessionCookie{}
+
+	for rows.Next() {
+		cookie, err := scanSQLiteSession(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cookies = append(cookies, cookie)
+	}
+
+	return cookies, rows.Err()
+}
+
+func (s *sqliteSessionStore) RevokeByID(ctx context.Context, user string, id string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user = ? AND id = ?", user, id)
+
+	if err != nil {
+		return err
+	}
+
+	return sqliteRequireUpdate(result)
+}
+
+func (s *sqliteSessionStore) DeleteExpired(ctx context.Context, now time.Time) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE expiry < ?", sqliteTime(now))
+
+	return err
+}
+
+// migrateSQLiteSessionTokenHashes replaces the stored session tokens with their hashes
+func migrateSQLiteSessionTokenHashes(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE sessions RENAME COLUMN token TO token_hash`); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT token_hash FROM sessions")
+
+	if err != nil {
+		return err
+	}
+
+	tokens := []string{}
+
+	for rows.Next() {
+		var token string
+
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if _, err := tx.Exec("UPDATE sessions SET token_hash = ? WHERE token_hash = ?", hashToken(token), token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+var errorTokenNotFound = errors.New("Token not found")
+
+// SessionStore persists login sessions
+type SessionStore interface {
+	// Lookup finds the session for a token, returning errorTokenNotFound if there is none
+	Lookup(ctx context.Context, token string) (*sessionCookie, error)
+	Create(ctx context.Context, cookie *sessionCookie) error
+	// Touch moves a session's expiry and records when it was last seen, returning errorTokenNotFound if it has been revoked
+	Touch(ctx context.Context, token string, expiry time.Time, lastSeen time.Time) error
+	Revoke(ctx context.Context, token string) error
+	// List finds all of a user's sessions
+	List(ctx context.Context, user string) ([]*sessionCookie, error)
+	// RevokeByID revokes one of a user's sessions, returning errorTokenNotFound if they have no such session
+	RevokeByID(ctx context.Context, user string, id string) error
+	// DeleteExpired removes every session which expired before now
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+// Stores are the persistent stores sharing the backend chosen by SESSION_STORE
+type Stores struct {
+	Sessions     SessionStore
+	AccessTokens AccessTokenStore
+	Pairings     PairingStore
+	Passkeys     PasskeyStore
+	Accounts     AccountStore
+	Items        ItemStore
+	Retention    RetentionStore
+	Usage        UsageStore
+	Shares       ShareStore
+	// Directory finds users to share items with by email
+	Directory DirectoryStore
+	// UserIDMigrations are the user IDs waiting for migrate-user-ids
+	UserIDMigrations UserIDMigrationStore
+}
+
+func openStores(ctx context.Context, projectID string) (*Stores, error) {
+	sessionStoreKind, sessionStoreKindDeclared := os.LookupEnv("SESSION_STORE")
+
+	if !sessionStoreKindDeclared {
+		sessionStoreKind = "datastore"
+		log.Println("Session store not declared, defaulting to", sessionStoreKind)
+	}
+
+	switch sessionStoreKind {
+	case "datastore":
+		if projectID == "" {
+			return nil, errors.New("Project ID not declared")
+		}
+
+		log.Println("Connecting to DataStore")
+		datastoreClient, err := datastore.NewClient(ctx, projectID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Stores{
+			Sessions:         newDatastoreSessionStore(datastoreClient),
+			AccessTokens:     newDatastoreAccessTokenStore(datastoreClient),
+			Pairings:         newDatastorePairingStore(datastoreClient),
+			Passkeys:         newDatastorePasskeyStore(datastoreClient),
+			Accounts:         newDatastoreAccountStore(datastoreClient),
+			Items:            newDatastoreItemStore(datastoreClient),
+			Retention:        newDatastoreRetentionStore(datastoreClient),
+			Usage:            newDatastoreUsageStore(datastoreClient),
+			Shares:           newDatastoreShareStore(datastoreClient),
+			Directory:        newDatastoreDirectoryStore(datastoreClient),
+			UserIDMigrations: newDatastoreUserIDMigrationStore(datastoreClient),
+		}, nil
+	case "sqlite":
+		sessionStorePath, sessionStorePathDeclared := os.LookupEnv("SESSION_STORE_PATH")
+
+		if !sessionStorePathDeclared {
+			return nil, errors.New("Session store path not declared")
+		}
+
+		log.Println("Opening SQLite database", sessionStorePath)
+		db, err := openSQLite(sessionStorePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Stores{
+			Sessions:         newSQLiteSessionStore(db),
+			AccessTokens:     newSQLiteAccessTokenStore(db),
+			Pairings:         newSQLitePairingStore(db),
+			Passkeys:         newSQLitePasskeyStore(db),
+			Accounts:         newSQLiteAccountStore(db),
+			Items:            newSQLiteItemStore(db),
+			Retention:        newSQLiteRetentionStore(db),
+			Usage:            newSQLiteUsageStore(db),
+			Shares:           newSQLiteShareStore(db),
+			Directory:        newSQLiteDirectoryStore(db),
+			UserIDMigrations: newSQLiteUserIDMigrationStore(db),
+		}, nil
+	case "memory":
+		log.Println("Using in-memory session store")
+		return &Stores{
+			Sessions:         newMemorySessionStore(),
+			AccessTokens:     newMemoryAccessTokenStore(),
+			Pairings:         newMemoryPairingStore(),
+			Passkeys:         newMemoryPasskeyStore(),
+			Accounts:         newMemoryAccountStore(),
+			Items:            newMemoryItemStore(),
+			Retention:        newMemoryRetentionStore(),
+			Usage:            newMemoryUsageStore(),
+			Shares:           newMemoryShareStore(),
+			Directory:        newMemoryDirectoryStore(),
+			UserIDMigrations: newMemoryUserIDMigrationStore(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown session store %q", sessionStoreKind)
+	}
+}
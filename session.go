@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const sessionRefreshPath = "/session/refresh"
+
+const logoutPath = "/logout"
+
+const sessionsPath = "/sessions"
+
+// sessionRevokedEvent tells a user's event streams that one of their sessions has ended
+const sessionRevokedEvent = "session-revoked"
+
+type sessionRevokedNotification struct {
+	Event   string
+	Session string
+}
+
+// sessionInfo describes a session to its user
+type sessionInfo struct {
+	ID         string
+	DeviceName string
+	UserAgent  string
+	IP         string
+	Created    time.Time
+	LastSeen   time.Time
+	Expiry     time.Time
+	Current    bool
+}
+
+// publishSessionRevoked ends any event streams of the session
+func publishSessionRevoked(ctx context.Context, bus NotificationBus, user string, id string) error {
+	notificationData, err := json.Marshal(&sessionRevokedNotification{
+		Event:   sessionRevokedEvent,
+		Session: id,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bus.Publish(ctx, user, notificationData)
+}
+
+type sessionStatus struct {
+	Expiry    time.Time
+	CSRFToken string
+}
+
+// sessionLogin tells a client who it logged in as, and the CSRF token of its new session
+type sessionLogin struct {
+	Email     string
+	Expiry    time.Time
+	CSRFToken string
+}
+
+type sessionRefreshHandler struct {
+	accessPolicy *AccessPolicy
+	sessionStore SessionStore
+}
+
+func (h *sessionRefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+		if err != nil {
+			log.Println("Invalid session:", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if err := refreshSession(r.Context(), h.sessionStore, session); err != nil {
+			log.Println("Error refreshing session:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(&sessionStatus{
+			Expiry:    session.Expiry,
+			CSRFToken: session.CSRFToken,
+		}); err != nil {
+			log.Println("Error writing session status:", err)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionRefreshHandler handles extending sessions which are still in use
+func SessionRefreshHandler(accessPolicy *AccessPolicy, sessionStore SessionStore) (string, http.Handler) {
+	return sessionRefreshPath, &sessionRefreshHandler{
+		accessPolicy: accessPolicy,
+		sessionStore: sessionStore,
+	}
+}
+
+type logoutHandler struct {
+	accessPolicy    *AccessPolicy
+	sessionStore    SessionStore
+	notificationBus NotificationBus
+}
+
+func (h *logoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+		if err != nil {
+			log.Println("Invalid session:", err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		if err := h.sessionStore.Revoke(r.Context(), session.Token); err != nil {
+			log.Println("Error revoking session:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := publishSessionRevoked(r.Context(), h.notificationBus, session.User, session.ID); err != nil {
+			log.Println("Error publishing session revocation:", err)
+		}
+
+		clearSessionCookie(w)
+
+		fmt.Fprintln(w, "Logged out")
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// LogoutHandler handles revoking the current session
+func LogoutHandler(accessPolicy *AccessPolicy, sessionStore SessionStore, notificationBus NotificationBus) (string, http.Handler) {
+	return logoutPath, &logoutHandler{
+		accessPolicy:    accessPolicy,
+		sessionStore:    sessionStore,
+		notificationBus: notificationBus,
+	}
+}
+
+type sessionsHandler struct {
+	accessPolicy    *AccessPolicy
+	sessionStore    SessionStore
+	notificationBus NotificationBus
+}
+
+func (h *sessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := getRequestSession(r.Context(), h.accessPolicy, h.sessionStore, r)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, sessionsPath), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		cookies, err := h.sessionStore.List(r.Context(), session.User)
+
+		if err != nil {
+			log.Println("Error listing sessions:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+
+		sessions := []sessionInfo{}
+
+		for _, cookie := range cookies {
+			if cookie.ID == "" || now.After(cookie.Expiry) {
+				continue
+			}
+
+			sessions = append(sessions, sessionInfo{
+				ID:         cookie.ID,
+				DeviceName: cookie.DeviceName,
+				UserAgent:  cookie.UserAgent,
+				IP:         cookie.IP,
+				Created:    cookie.Created,
+				LastSeen:   cookie.LastSeen,
+				Expiry:     cookie.Expiry,
+				Current:    cookie.ID == session.ID,
+			})
+		}
+
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].LastSeen.After(sessions[j].LastSeen)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			log.Println("Error writing sessions:", err)
+		}
+	case r.Method == "DELETE" && id != "":
+		if err := h.sessionStore.RevokeByID(r.Context(), session.User, id); err == errorTokenNotFound {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error revoking session:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if err := publishSessionRevoked(r.Context(), h.notificationBus, session.User, id); err != nil {
+			log.Println("Error publishing session revocation:", err)
+		}
+
+		if id == session.ID {
+			clearSessionCookie(w)
+		}
+
+		fmt.Fprintln(w, "Revoked")
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// SessionsHandler handles listing and revoking a user's sessions, under its path and the path of each session
+func SessionsHandler(accessPolicy *AccessPolicy, sessionStore SessionStore, notificationBus NotificationBus) (string, http.Handler) {
+	return sessionsPath, &sessionsHandler{
+		accessPolicy:    accessPolicy,
+		sessionStore:    sessionStore,
+		notificationBus: notificationBus,
+	}
+}
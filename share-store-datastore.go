@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreShareStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreShareStore(c *datastore.Client) *datastoreShareStore {
+	return &datastoreShareStore{
+		c: c,
+	}
+}
+
+func itemShareKey(owner string, id string, recipient string) *datastore.Key {
+	return datastore.NameKey(itemShareKind, itemShareName(owner, id, recipient), nil)
+}
+
+func (s *datastoreShareStore) Put(ctx context.Context, share *itemShare) error {
+	_, err := s.c.Put(ctx, itemShareKey(share.Owner, share.ID, share.Recipient), share)
+
+	return err
+}
+
+func (s *datastoreShareStore) List(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	shares := []*itemShare{}
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(itemShareKind).Filter("Owner =", owner).Filter("ID =", id), &shares); err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+func (s *datastoreShareStore) Received(ctx context.Context, recipient string, query itemQuery) ([]*itemShare, error) {
+	// Needs the composite index on Recipient and descending ID in index.yaml
+	q := datastore.NewQuery(itemShareKind).Filter("Recipient =", recipient).Order("-ID")
+
+	if query.From != "" {
+		q = q.Filter("ID >=", query.From)
+	}
+
+	if query.Before != "" {
+		q = q.Filter("ID <", query.Before)
+	}
+
+	if query.Offset > 0 {
+		q = q.Offset(query.Offset)
+	}
+
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+
+	shares := []*itemShare{}
+
+	if _, err := s.c.GetAll(ctx, q, &shares); err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+func (s *datastoreShareStore) CountReceived(ctx context.Context, recipient string) (int, error) {
+	return s.c.Count(ctx, datastore.NewQuery(itemShareKind).Filter("Recipient =", recipient).KeysOnly())
+}
+
+func (s *datastoreShareStore) Delete(ctx context.Context, owner string, id string, recipient string) error {
+	key := itemShareKey(owner, id, recipient)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var share itemShare
+
+		if err := tx.Get(key, &share); err == datastore.ErrNoSuchEntity {
+			return errorShareNotFound
+		} else if err != nil {
+			return err
+		}
+
+		return tx.Delete(key)
+	})
+
+	return err
+}
+
+func (s *datastoreShareStore) DeleteItem(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	shares := []*itemShare{}
+
+	keys, err := s.c.GetAll(ctx, datastore.NewQuery(itemShareKind).Filter("Owner =", owner).Filter("ID =", id), &shares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := datastoreBatches(len(keys), func(start int, end int) error {
+		return s.c.DeleteMulti(ctx, keys[start:end])
+	}); err != nil {
+		return nil, err
+	}
+
+	return shares, nil
+}
+
+func (s *datastoreShareStore) Reassign(ctx context.Context, from string, to string) error {
+	for _, property := range []string{"Owner =", "Recipient ="} {
+		var shares []*itemShare
+
+		keys, err := s.c.GetAll(ctx, datastore.NewQuery(itemShareKind).Filter(property, from), &shares)
+
+		if err != nil {
+			return err
+		}
+
+		newKeys := make([]*datastore.Key, len(shares))
+
+		for i, share := range shares {
+			if share.Owner == from {
+				share.Owner = to
+			}
+
+			if share.Recipient == from {
+				share.Recipient = to
+			}
+
+			newKeys[i] = itemShareKey(share.Owner, share.ID, share.Recipient)
+		}
+
+		// The owner and recipient are part of the keys, so the grants are written under new keys before the old ones are removed
+		if err := datastoreBatches(len(keys), func(start int, end int) error {
+			if _, err := s.c.PutMulti(ctx, newKeys[start:end], shares[start:end]); err != nil {
+				return err
+			}
+
+			return s.c.DeleteMulti(ctx, keys[start:end])
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryShareStore keeps grants for the lifetime of the process
+type memoryShareStore struct {
+	lock   sync.Mutex
+	shares map[string]itemShare
+}
+
+func newMemoryShareStore() *memoryShareStore {
+	return &memoryShareStore{
+		shares: make(map[string]itemShare),
+	}
+}
+
+func (s *memoryShareStore) Put(ctx context.Context, share *itemShare) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.shares[itemShareName(share.Owner, share.ID, share.Recipient)] = *share
+
+	return nil
+}
+
+func (s *memoryShareStore) List(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	shares := []*itemShare{}
+
+	for _, share := range s.shares {
+		if share.Owner == owner && share.ID == id {
+			share := share
+			shares = append(shares, &share)
+		}
+	}
+
+	return shares, nil
+}
+
+func (s *memoryShareStore) Received(ctx context.Context, recipient string, query itemQuery) ([]*itemShare, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	shares := []*itemShare{}
+
+	for _, share := range s.shares {
+		if share.Recipient != recipient || query.From != "" && share.ID < query.From || query.Before != "" && share.ID >= query.Before {
+			continue
+		}
+
+		share := share
+		shares = append(shares, &share)
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].ID > shares[j].ID
+	})
+
+	if query.Offset >= len(shares) {
+		return []*itemShare{}, nil
+	}
+
+	shares = shares[query.Offset:]
+
+	if query.Limit > 0 && len(shares) > query.Limit {
+		shares = shares[:query.Limit]
+	}
+
+	return shares, nil
+}
+
+func (s *memoryShareStore) CountReceived(ctx context.Context, recipient string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+
+	for _, share := range s.shares {
+		if share.Recipient == recipient {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memoryShareStore) Delete(ctx context.Context, owner string, id string, recipient string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	name := itemShareName(owner, id, recipient)
+
+	if _, found := s.shares[name]; !found {
+		return errorShareNotFound
+	}
+
+	delete(s.shares, name)
+
+	return nil
+}
+
+func (s *memoryShareStore) DeleteItem(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	shares := []*itemShare{}
+
+	for name, share := range s.shares {
+		if share.Owner == owner && share.ID == id {
+			delete(s.shares, name)
+
+			share := share
+			shares = append(shares, &share)
+		}
+	}
+
+	return shares, nil
+}
+
+func (s *memoryShareStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name, share := range s.shares {
+		if share.Owner != from && share.Recipient != from {
+			continue
+		}
+
+		delete(s.shares, name)
+
+		if share.Owner == from {
+			share.Owner = to
+		}
+
+		if share.Recipient == from {
+			share.Recipient = to
+		}
+
+		s.shares[itemShareName(share.Owner, share.ID, share.Recipient)] = share
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+type sqliteShareStore struct {
+	db *sql.DB
+}
+
+func newSQLiteShareStore(db *sql.DB) *sqliteShareStore {
+	return &sqliteShareStore{
+		db: db,
+	}
+}
+
+const sqliteShareColumns = "owner, id, recipient, owner_email, recipient_email, created"
+
+func scanSQLiteShare(row sqliteScanner) (*itemShare, error) {
+	var share itemShare
+
+	var created int64
+
+	if err := row.Scan(&share.Owner, &share.ID, &share.Recipient, &share.OwnerEmail, &share.RecipientEmail, &created); err != nil {
+		return nil, err
+	}
+
+	share.Created = fromSQLiteTime(created)
+
+	return &share, nil
+}
+
+func (s *sqliteShareStore) query(ctx context.Context, statement string, args ...interface{}) ([]*itemShare, error) {
+	rows, err := s.db.QueryContext(ctx, statement, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	shares := []*itemShare{}
+
+	for rows.Next() {
+		share, err := scanSQLiteShare(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, rows.Err()
+}
+
+func (s *sqliteShareStore) Put(ctx context.Context, share *itemShare) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO item_shares ("+sqliteShareColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		share.Owner, share.ID, share.Recipient, share.OwnerEmail, share.RecipientEmail, sqliteTime(share.Created))
+
+	return err
+}
+
+func (s *sqliteShareStore) List(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	return s.query(ctx, "SELECT "+sqliteShareColumns+" FROM item_shares WHERE owner = ? AND id = ?", owner, id)
+}
+
+func (s *sqliteShareStore) Received(ctx context.Context, recipient string, query itemQuery) ([]*itemShare, error) {
+	statement := "SELECT " + sqliteShareColumns + " FROM item_shares WHERE recipient = ?"
+
+	args := []interface{}{recipient}
+
+	if query.From != "" {
+		statement += " AND id >= ?"
+		args = append(args, query.From)
+	}
+
+	if query.Before != "" {
+		statement += " AND id < ?"
+		args = append(args, query.Before)
+	}
+
+	statement += " ORDER BY id DESC"
+
+	// SQLite only takes an offset after a limit, where a negative limit is no limit
+	if query.Limit > 0 || query.Offset > 0 {
+		limit := query.Limit
+
+		if limit == 0 {
+			limit = -1
+		}
+
+		statement += " LIMIT ? OFFSET ?"
+		args = append(args, limit, query.Offset)
+	}
+
+	return s.query(ctx, statement, args...)
+}
+
+func (s *sqliteShareStore) CountReceived(ctx context.Context, recipient string) (int, error) {
+	var count int
+
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM item_shares WHERE recipient = ?", recipient).Scan(&count)
+
+	return count, err
+}
+
+func (s *sqliteShareStore) Delete(ctx context.Context, owner string, id string, recipient string) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM item_shares WHERE owner = ? AND id = ? AND recipient = ?", owner, id, recipient)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return errorShareNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteShareStore) DeleteItem(ctx context.Context, owner string, id string) ([]*itemShare, error) {
+	return s.query(ctx, "DELETE FROM item_shares WHERE owner = ? AND id = ? RETURNING "+sqliteShareColumns, owner, id)
+}
+
+func (s *sqliteShareStore) Reassign(ctx context.Context, from string, to string) error {
+	if _, err := s.db.ExecContext(ctx, "UPDATE OR REPLACE item_shares SET owner = ? WHERE owner = ?", to, from); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE OR REPLACE item_shares SET recipient = ? WHERE recipient = ?", to, from)
+
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const itemShareKind = "ItemShare"
+
+var errorShareNotFound = errors.New("Share not found")
+
+// itemShare grants a user access to another user's item
+type itemShare struct {
+	Owner     string
+	ID        string
+	Recipient string
+	// OwnerEmail identifies who shared the item to the recipient
+	OwnerEmail     string
+	RecipientEmail string
+	Created        time.Time
+}
+
+// object gives the name of the blob holding the shared item
+func (share *itemShare) object() string {
+	return itemObjectName(share.Owner, share.ID)
+}
+
+// itemShareName gives the name a grant is stored under
+func itemShareName(owner string, id string, recipient string) string {
+	return itemObjectName(owner, id) + "/" + recipient
+}
+
+// ShareStore persists grants of items to other users, keyed by owner, item and recipient
+type ShareStore interface {
+	// Put records a grant, replacing any earlier grant of the item to the recipient
+	Put(ctx context.Context, share *itemShare) error
+	// List finds the grants of one of an owner's items
+	List(ctx context.Context, owner string, id string) ([]*itemShare, error)
+	// Received finds the grants to a recipient whose item IDs match the query, newest first
+	Received(ctx context.Context, recipient string, query itemQuery) ([]*itemShare, error)
+	CountReceived(ctx context.Context, recipient string) (int, error)
+	// Delete removes a grant, returning errorShareNotFound if there is none
+	Delete(ctx context.Context, owner string, id string, recipient string) error
+	// DeleteItem removes every grant of an item, returning them
+	DeleteItem(ctx context.Context, owner string, id string) ([]*itemShare, error)
+	// Reassign moves the grants made by and to a user to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const itemShareSegment = "share"
+
+// itemSharedEvent tells a user's event streams that another user has shared an item with them
+const itemSharedEvent = "shared"
+
+type itemSharedNotification struct {
+	Event string
+	fileNotification
+}
+
+// shareRequest names the user to share an item with by the email they sign in with
+type shareRequest struct {
+	Email string
+}
+
+// shareGrant describes a grant of an item to its owner, naming the recipient by email so their user ID is never revealed
+type shareGrant struct {
+	Email   string
+	Created time.Time
+}
+
+// listedItem is an item in a user's history, with the grant it was shared by if it belongs to another user
+type listedItem struct {
+	*clipItem
+	share *itemShare
+}
+
+// listItems finds a user's own items and the items shared with them matching the query, newest first.
+// The offset applies to each separately, so only Before and Limit page through both.
+func listItems(ctx context.Context, itemStore ItemStore, shareStore ShareStore, user string, query itemQuery) ([]*listedItem, error) {
+	items, err := itemStore.List(ctx, user, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := shareStore.Received(ctx, user, query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listed := make([]*listedItem, 0, len(items)+len(shares))
+
+	for _, item := range items {
+		listed = append(listed, &listedItem{
+			clipItem: item,
+		})
+	}
+
+	for _, share := range shares {
+		item, err := itemStore.Get(ctx, share.object())
+
+		if err == errorItemNotFound {
+			// Removed without its grants, such as by reconcile-items
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		listed = append(listed, &listedItem{
+			clipItem: item,
+			share:    share,
+		})
+	}
+
+	sort.SliceStable(listed, func(i, j int) bool {
+		return listed[i].ID > listed[j].ID
+	})
+
+	if query.Limit > 0 && len(listed) > query.Limit {
+		listed = listed[:query.Limit]
+	}
+
+	return listed, nil
+}
+
+// countItems counts a user's own items and the items shared with them
+func countItems(ctx context.Context, itemStore ItemStore, shareStore ShareStore, user string) (int, error) {
+	count, err := itemStore.Count(ctx, user)
+
+	if err != nil {
+		return 0, err
+	}
+
+	shared, err := shareStore.CountReceived(ctx, user)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count + shared, nil
+}
+
+// recordDirectoryEntry notes the user an email belongs to, so that others can share items with them.
+// Only emails verified by an identity provider are given, and an email already recorded for another user is left to them,
+// so that nobody can redirect items shared with someone else.
+func recordDirectoryEntry(ctx context.Context, directoryStore DirectoryStore, email string, user string) error {
+	if email == "" {
+		return nil
+	}
+
+	err := directoryStore.Put(ctx, &directoryEntry{
+		Email:   directoryEmail(email),
+		User:    user,
+		Updated: time.Now(),
+	})
+
+	if err == errorEmailClaimed {
+		log.Println("Not recording the email of", user+", as it belongs to another user")
+		return nil
+	}
+
+	return err
+}
+
+// receivedShare finds the grant of an item with an ID to a recipient, returning errorShareNotFound if there is none.
+// IDs are only unique to their owner, so the newest grant is taken if several owners' items share one.
+func receivedShare(ctx context.Context, shareStore ShareStore, recipient string, id string) (*itemShare, error) {
+	// No other ID sorts between an ID and itself followed by the smallest byte
+	shares, err := shareStore.Received(ctx, recipient, itemQuery{
+		From:   id,
+		Before: id + "\x00",
+		Limit:  1,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(shares) == 0 {
+		return nil, errorShareNotFound
+	}
+
+	return shares[0], nil
+}
+
+// publishItemShared sends a shared item to every connected device of its recipient
+func publishItemShared(ctx context.Context, bus NotificationBus, blobStore BlobStore, downloadURLs *DownloadURLs, item *clipItem, share *itemShare) error {
+	notification, err := readFileNotification(ctx, blobStore, downloadURLs, &listedItem{
+		clipItem: item,
+		share:    share,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	notificationData, err := json.Marshal(&itemSharedNotification{
+		Event:            itemSharedEvent,
+		fileNotification: *notification,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bus.Publish(ctx, share.Recipient, notificationData)
+}
+
+// publishSharesRevoked tells the recipients of grants to drop the items they were shared, as if they had been deleted
+func publishSharesRevoked(ctx context.Context, bus NotificationBus, shares []*itemShare) error {
+	recipientIDs := make(map[string][]string)
+
+	for _, share := range shares {
+		recipientIDs[share.Recipient] = append(recipientIDs[share.Recipient], share.ID)
+	}
+
+	for recipient, ids := range recipientIDs {
+		if err := publishItemsDeleted(ctx, bus, recipient, ids); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitSharePath gives the item ID and recipient email named by a path under an item's shares, where the recipient is empty for the shares themselves
+func splitSharePath(urlPath string) (id string, recipient string, ok bool) {
+	if !strings.HasPrefix(urlPath, itemsPath+"/") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(urlPath, itemsPath+"/"), "/", 3)
+
+	if len(parts) < 2 || parts[1] != itemShareSegment {
+		return "", "", false
+	}
+
+	if len(parts) == 3 {
+		recipient = parts[2]
+	}
+
+	return parts[0], recipient, true
+}
+
+// share grants another user access to an item, found by the email they sign in with
+func (h *itemsHandler) share(w http.ResponseWriter, r *http.Request, id string) {
+	// Sharing puts items on other users' clipboards, so needs the same scope as uploading
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeUpload)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := checkItemID(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Recipients are told who shared an item by email
+	if auth.Email == "" {
+		http.Error(w, "Only users with a verified email can share items", http.StatusForbidden)
+		return
+	}
+
+	var request shareRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.itemStore.Get(r.Context(), itemObjectName(auth.User, id))
+
+	if err == errorItemNotFound || err == nil && item.expired(time.Now()) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error getting item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	entry, err := h.directoryStore.Lookup(r.Context(), directoryEmail(request.Email))
+
+	// Sharing with an email nobody has signed in with looks the same as sharing with one somebody has, so that emails cannot be probed
+	if err == errorUserNotFound {
+		fmt.Fprintln(w, "Shared")
+		return
+	} else if err != nil {
+		log.Println("Error looking up user:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if entry.User == auth.User {
+		http.Error(w, "Items cannot be shared with yourself", http.StatusBadRequest)
+		return
+	}
+
+	share := &itemShare{
+		Owner:          auth.User,
+		ID:             id,
+		Recipient:      entry.User,
+		OwnerEmail:     auth.Email,
+		RecipientEmail: entry.Email,
+		Created:        time.Now(),
+	}
+
+	if err := h.shareStore.Put(r.Context(), share); err != nil {
+		log.Println("Error sharing item:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The recipient still finds the item in their history if their devices miss this
+	if err := publishItemShared(r.Context(), h.notificationBus, h.blobStore, h.downloadURLs, item, share); err != nil {
+		log.Println("Error publishing share:", err)
+	}
+
+	fmt.Fprintln(w, "Shared")
+}
+
+// listShares responds with the grants of one of the user's items
+func (h *itemsHandler) listShares(w http.ResponseWriter, r *http.Request, id string) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeRead)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := checkItemID(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	shares, err := h.shareStore.List(r.Context(), auth.User, id)
+
+	if err != nil {
+		log.Println("Error listing shares:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	grants := []*shareGrant{}
+
+	for _, share := range shares {
+		grants = append(grants, &shareGrant{
+			Email:   share.RecipientEmail,
+			Created: share.Created,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(grants); err != nil {
+		log.Println("Error writing shares:", err)
+	}
+}
+
+// unshare revokes a grant of one of the user's items by the recipient's email, removing the item from the recipient's devices
+func (h *itemsHandler) unshare(w http.ResponseWriter, r *http.Request, id string, recipientEmail string) {
+	auth, err := authenticateRequest(r.Context(), h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeUpload)
+
+	if err != nil {
+		log.Println("Invalid session:", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if err := checkItemID(id); err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	entry, err := h.directoryStore.Lookup(r.Context(), directoryEmail(recipientEmail))
+
+	if err == errorUserNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error looking up user:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	share := &itemShare{
+		Owner:     auth.User,
+		ID:        id,
+		Recipient: entry.User,
+	}
+
+	if err := h.shareStore.Delete(r.Context(), share.Owner, share.ID, share.Recipient); err == errorShareNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error revoking share:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := publishSharesRevoked(r.Context(), h.notificationBus, []*itemShare{share}); err != nil {
+		log.Println("Error publishing revoked share:", err)
+	}
+
+	fmt.Fprintln(w, "Unshared")
+}
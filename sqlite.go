@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// Registers the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type sqliteMigration func(tx *sql.Tx) error
+
+// sqliteMigrations are applied in order, tracked by the database's user_version
+var sqliteMigrations = []sqliteMigration{
+	sqliteStatements(`CREATE TABLE sessions (
+		token TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		email TEXT NOT NULL,
+		expiry INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_expiry ON sessions (expiry);`),
+	sqliteStatements(`ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT '';`),
+	migrateSQLiteSessionTokenHashes,
+	sqliteStatements(`ALTER TABLE sessions ADD COLUMN created INTEGER NOT NULL DEFAULT 0;`),
+	sqliteStatements(`ALTER TABLE sessions ADD COLUMN id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN device_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN last_seen INTEGER NOT NULL DEFAULT 0;
+	UPDATE sessions SET id = lower(hex(randomblob(16)));
+	CREATE INDEX sessions_user ON sessions (user);`),
+	sqliteStatements(`CREATE TABLE access_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		email TEXT NOT NULL,
+		id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expiry INTEGER NOT NULL,
+		last_used INTEGER NOT NULL
+	);
+	CREATE INDEX access_tokens_user ON access_tokens (user);
+	CREATE INDEX access_tokens_expiry ON access_tokens (expiry);`),
+	sqliteStatements(`CREATE TABLE pairing_requests (
+		device_code_hash TEXT PRIMARY KEY,
+		user_code TEXT NOT NULL UNIQUE,
+		device_name TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expiry INTEGER NOT NULL,
+		last_polled INTEGER NOT NULL,
+		user TEXT NOT NULL,
+		email TEXT NOT NULL
+	);
+	CREATE INDEX pairing_requests_expiry ON pairing_requests (expiry);`),
+	sqliteStatements(`CREATE TABLE passkeys (
+		id TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		email TEXT NOT NULL,
+		name TEXT NOT NULL,
+		credential BLOB NOT NULL,
+		created INTEGER NOT NULL,
+		last_used INTEGER NOT NULL
+	);
+	CREATE INDEX passkeys_user ON passkeys (user);
+	CREATE TABLE passkey_ceremonies (
+		id TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		data BLOB NOT NULL,
+		expiry INTEGER NOT NULL
+	);
+	CREATE INDEX passkey_ceremonies_expiry ON passkey_ceremonies (expiry);`),
+	sqliteStatements(`CREATE TABLE local_accounts (
+		username TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		email TEXT NOT NULL,
+		password_hash TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		password_changed INTEGER NOT NULL,
+		failed_logins INTEGER NOT NULL,
+		locked_until INTEGER NOT NULL
+	);`),
+	sqliteStatements(`ALTER TABLE passkeys ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+	CREATE INDEX local_accounts_user ON local_accounts (user);
+	CREATE TABLE user_id_migrations (
+		from_user TEXT PRIMARY KEY,
+		to_user TEXT NOT NULL,
+		created INTEGER NOT NULL
+	);`),
+	sqliteStatements(`CREATE TABLE clip_items (
+		object TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		preview TEXT NOT NULL
+	);
+	CREATE INDEX clip_items_user_id ON clip_items (user, id);`),
+	sqliteStatements(`ALTER TABLE clip_items ADD COLUMN expiry INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX clip_items_expiry ON clip_items (expiry);
+	CREATE TABLE retention_settings (
+		user TEXT PRIMARY KEY,
+		max_age_days INTEGER NOT NULL,
+		max_items INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	);`),
+	sqliteStatements(`CREATE TABLE user_usage (
+		user TEXT PRIMARY KEY,
+		bytes INTEGER NOT NULL,
+		items INTEGER NOT NULL,
+		max_bytes INTEGER NOT NULL,
+		max_items INTEGER NOT NULL,
+		max_item_size INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	);`),
+	sqliteStatements(`CREATE TABLE item_shares (
+		owner TEXT NOT NULL,
+		id TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		owner_email TEXT NOT NULL,
+		recipient_email TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		PRIMARY KEY (owner, id, recipient)
+	);
+	CREATE INDEX item_shares_recipient ON item_shares (recipient, id);
+	CREATE TABLE directory (
+		email TEXT PRIMARY KEY,
+		user TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	);
+	CREATE INDEX directory_user ON directory (user);`),
+	sqliteStatements(`ALTER TABLE sessions ADD COLUMN user_key TEXT NOT NULL DEFAULT '';
+	ALTER TABLE access_tokens ADD COLUMN user_key TEXT NOT NULL DEFAULT '';
+	ALTER TABLE pairing_requests ADD COLUMN user_key TEXT NOT NULL DEFAULT '';`),
+	sqliteStatements(`ALTER TABLE passkeys ADD COLUMN user_key TEXT NOT NULL DEFAULT '';`),
+	sqliteStatements(`CREATE TABLE resolved_user_ids (
+		user TEXT PRIMARY KEY,
+		created INTEGER NOT NULL
+	);`),
+}
+
+func sqliteStatements(statements string) sqliteMigration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+
+		return err
+	}
+}
+
+// sqliteTime stores times as nanoseconds since the epoch, with the zero time as 0
+func sqliteTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func fromSQLiteTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanoseconds)
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on", path))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		if err := sqliteMigrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
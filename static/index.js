@@ -1,7 +1,9 @@
 "use strict";
 
 var eventSource;
-var sessionToken;
+var csrfToken;
+
+const reconnectDelay = 5000;
 
 function uploadFile(name, type, body) {
     return new Promise(function (resolve, reject) {
@@ -18,10 +20,10 @@ function uploadFile(name, type, body) {
         }
 
         xmlHttp.open("POST", "/upload?" + $.param({
-            "name": name,
-            "token": sessionToken
+            "name": name
         }, true));
         xmlHttp.setRequestHeader("Content-type", type);
+        xmlHttp.setRequestHeader("X-CSRF-Token", csrfToken);
         xmlHttp.send(body);
     })
 }
@@ -33,43 +35,262 @@ function onGoogleSignIn(googleUser) {
 
     const token = googleUser.getAuthResponse().id_token;
 
-    eventSource = new EventSource("/events?token=" + token);
+    connectEvents("/events?" + $.param({
+        "token": token,
+        "device": navigator.platform
+    }));
+}
+
+function fromBase64URL(text) {
+    const binary = atob(text.replace(/-/g, "+").replace(/_/g, "/"));
+
+    return Uint8Array.from(binary, function (c) {
+        return c.charCodeAt(0);
+    }).buffer;
+}
+
+function toBase64URL(buffer) {
+    const binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function postJSON(url, data) {
+    return $.ajax({
+        "method": "POST",
+        "url": url,
+        "contentType": "application/json",
+        "data": JSON.stringify(data),
+        "headers": csrfToken ? {
+            "X-CSRF-Token": csrfToken
+        } : {}
+    });
+}
+
+async function signInWithPasskey() {
+    const assertion = await postJSON("/passkeys/login/begin", {});
+    const options = assertion.publicKey;
+
+    options.challenge = fromBase64URL(options.challenge);
+
+    const credential = await navigator.credentials.get({
+        "publicKey": options
+    });
+
+    const login = await postJSON("/passkeys/login/finish", {
+        "id": credential.id,
+        "rawId": toBase64URL(credential.rawId),
+        "type": credential.type,
+        "response": {
+            "authenticatorData": toBase64URL(credential.response.authenticatorData),
+            "clientDataJSON": toBase64URL(credential.response.clientDataJSON),
+            "signature": toBase64URL(credential.response.signature),
+            "userHandle": toBase64URL(credential.response.userHandle)
+        }
+    });
+
+    $("body").addClass("signed-in").addClass("loading-history");
+
+    $("#user-name").text(login.Email);
+
+    connectEvents("/events");
+}
 
-    eventSource.onerror = function (ev) {
+async function addPasskey() {
+    const creation = await postJSON("/passkeys/register/begin", {});
+    const options = creation.publicKey;
+
+    options.challenge = fromBase64URL(options.challenge);
+    options.user.id = fromBase64URL(options.user.id);
+    (options.excludeCredentials || []).forEach(function (descriptor) {
+        descriptor.id = fromBase64URL(descriptor.id);
+    });
+
+    const credential = await navigator.credentials.create({
+        "publicKey": options
+    });
+
+    await postJSON("/passkeys/register/finish?" + $.param({
+        "name": navigator.platform
+    }), {
+        "id": credential.id,
+        "rawId": toBase64URL(credential.rawId),
+        "type": credential.type,
+        "response": {
+            "attestationObject": toBase64URL(credential.response.attestationObject),
+            "clientDataJSON": toBase64URL(credential.response.clientDataJSON)
+        }
+    });
+}
+
+function onLocalSignIn(url, username, password) {
+    return postJSON(url, {
+        "Username": username,
+        "Password": password
+    }).then(function (login) {
+        $("body").addClass("signed-in").addClass("loading-history");
+
+        $("#user-name").text(login.Email || username);
+
+        connectEvents("/events");
+    });
+}
+
+function createItem(message) {
+    const item = $("<div/>", {
+        "x-created": message.Created,
+        "x-id": message.ID
+    });
+
+    switch (message.Type) {
+        case "text/x-clipboard":
+            item.append($("<textarea/>", {
+                "val": message.Body
+            }));
+            break;
+        default:
+            // Signed URLs expire, while the session keeps working for as long as the page is open
+            item.append($("<a/>", {
+                "text": message.Name,
+                "href": "/items/" + message.ID + "/content",
+                "target": "blank"
+            }));
+            break;
+    }
+
+    if (message.SharedBy) {
+        return item.append($("<span/>", {
+            "class": "shared-by",
+            "text": "Shared by " + message.SharedBy
+        }));
+    }
+
+    return item.append($("<a/>", {
+        "class": "share-item",
+        "text": "Share",
+        "href": "#"
+    }), $("<a/>", {
+        "class": "delete-item",
+        "text": "Delete",
+        "href": "#"
+    }));
+}
+
+// loadOlderItems fetches the page of items before the oldest one shown, as the event stream only replays the newest
+function loadOlderItems() {
+    const oldest = $("#received-items").children().first().attr("x-id");
+
+    return $.ajax({
+        "method": "GET",
+        "url": "/items?" + $.param(oldest ? {
+            "before": oldest
+        } : {}),
+        "dataType": "json"
+    }).done(function (page) {
+        page.Items.forEach(function (message) {
+            const shown = $("#received-items").children().filter(function () {
+                return $(this).attr("x-id") === message.ID;
+            });
+
+            if (shown.length === 0) {
+                createItem(message).prependTo("#received-items");
+            }
+        });
+
+        $("#load-older-items").toggle(page.Next !== "");
+    });
+}
+
+function connectEvents(url) {
+    const source = new EventSource(url);
+
+    var connected = false;
+
+    eventSource = source;
+
+    source.onerror = function (ev) {
         console.log("Event Source closed:", ev);
         this.close()
-        $("body").addClass("disconnected");
+
+        if (connected) {
+            // Resume with the session cookie, as the sign-in token may have expired
+            setTimeout(function () {
+                if (eventSource === source) {
+                    connectEvents("/events");
+                }
+            }, reconnectDelay);
+        } else {
+            $("body").addClass("disconnected");
+        }
     }
 
-    eventSource.onmessage = function (ev) {
-        if (sessionToken == undefined) {
+    source.onmessage = function (ev) {
+        if (!connected) {
+            connected = true;
             $("body").removeClass("loading-history");
-            sessionToken = ev.data.trim();
+            $("#received-items").empty();
+            $("#load-older-items").show();
+            csrfToken = ev.data.trim();
         } else {
             const message = JSON.parse(atob(ev.data.trim()));
 
-            switch (message.Type) {
-                case "text/x-clipboard":
-                    $("<div/>", {
-                        "x-created": message.Created
-                    }).append($("<textarea/>", {
-                        "val": message.Body
-                    })).appendTo("#received-items");
-                    break;
-                default:
-                    $("<div/>", {
-                        "x-created": message.Created
-                    }).append($("<a/>", {
-                        "text": message.Name,
-                        "href": message.URL,
-                        "target": "blank"
-                    })).appendTo("#received-items");
-                    break;
+            if (message.Event === "deleted") {
+                message.IDs.forEach(function (id) {
+                    $("#received-items").children().filter(function () {
+                        return $(this).attr("x-id") === id;
+                    }).remove();
+                });
+                return;
+            } else if (message.Event === "shared") {
+                const shown = $("#received-items").children().filter(function () {
+                    return $(this).attr("x-id") === message.ID;
+                });
+
+                // An item shared again is already shown
+                if (shown.length > 0) {
+                    return;
+                }
+            } else if (message.Event) {
+                return;
             }
+
+            createItem(message).appendTo("#received-items");
         }
     }
 }
 
+function deleteItem(id) {
+    return $.ajax({
+        "method": "DELETE",
+        "url": "/items/" + encodeURIComponent(id),
+        "headers": {
+            "X-CSRF-Token": csrfToken
+        }
+    });
+}
+
+function shareItem(id, email) {
+    return postJSON("/items/" + encodeURIComponent(id) + "/share", {
+        "Email": email
+    });
+}
+
+function logout() {
+    return $.ajax({
+        "method": "POST",
+        "url": "/logout",
+        "headers": {
+            "X-CSRF-Token": csrfToken
+        }
+    });
+}
+
+function approvePairing(userCode) {
+    return postJSON("/pair/approve", {
+        "UserCode": userCode
+    });
+}
+
 function loadFile(file) {
     return new Promise(function (resolve, reject) {
         const fileReader = new FileReader();
@@ -109,6 +330,10 @@ $.when($.ready).then(function () {
     $("#sign-out").click(function () {
         var auth2 = gapi.auth2.getAuthInstance();
 
+        logout().fail(function (xhr) {
+            console.log("Failed to end session:", xhr.status);
+        });
+
         auth2.disconnect();
 
         auth2.signOut().then(function () {
@@ -119,13 +344,14 @@ $.when($.ready).then(function () {
                 eventSource.close();
                 eventSource = undefined;
             }
-            sessionToken = undefined;
+            csrfToken = undefined;
 
             $("#user-name").text("");
 
             $("#paste-form textarea").val("");
 
             $("#received-items").empty();
+            $("#load-older-items").show();
         });
 
     })
@@ -136,6 +362,83 @@ $.when($.ready).then(function () {
         await uploadFile("Clipboard", "text/x-clipboard", $(transmitEvent.target).find("textarea").val());
     });
 
+    $("#local-sign-in").submit(function (signInEvent) {
+        signInEvent.preventDefault();
+
+        const form = signInEvent.target;
+
+        onLocalSignIn("/accounts/login", form.username.value, form.password.value).fail(function (xhr) {
+            alert("Failed to sign in: " + xhr.responseText);
+        });
+    });
+
+    $("#local-register").click(function () {
+        const form = $("#local-sign-in")[0];
+
+        onLocalSignIn("/accounts/register", form.username.value, form.password.value).fail(function (xhr) {
+            alert("Failed to register: " + xhr.responseText);
+        });
+    });
+
+    $("#passkey-sign-in").click(function () {
+        signInWithPasskey().catch(function (err) {
+            console.log("Failed to sign in with passkey:", err);
+        });
+    });
+
+    $("#add-passkey").click(function (ev) {
+        ev.preventDefault();
+
+        addPasskey().then(function () {
+            alert("Passkey added");
+        }).catch(function (err) {
+            console.log("Failed to add passkey:", err);
+        });
+    });
+
+    $("#load-older-items").click(function (ev) {
+        ev.preventDefault();
+
+        loadOlderItems().fail(function (xhr) {
+            console.log("Error loading older items:", xhr.statusText);
+        });
+    });
+
+    $("#received-items").on("click", ".delete-item", function (ev) {
+        ev.preventDefault();
+
+        deleteItem($(this).parent().attr("x-id")).fail(function (xhr) {
+            console.log("Error deleting item:", xhr.statusText);
+        });
+    });
+
+    $("#received-items").on("click", ".share-item", function (ev) {
+        ev.preventDefault();
+
+        const email = prompt("Share with email:");
+
+        if (!email) {
+            return;
+        }
+
+        shareItem($(this).parent().attr("x-id"), email).fail(function (xhr) {
+            console.log("Error sharing item:", xhr.statusText);
+        });
+    });
+
+    $("#pair-form").submit(function (pairEvent) {
+        pairEvent.preventDefault();
+
+        const input = $(pairEvent.target).find("input[type=text]");
+
+        approvePairing(input.val()).done(function (approved) {
+            input.val("");
+            alert("Paired " + (approved.DeviceName || "device"));
+        }).fail(function (xhr) {
+            alert("Failed to pair device: " + xhr.responseText);
+        });
+    });
+
     $("#file-drop-area").on("dragstart drag", function (ev) {
         ev.preventDefault();
     }).on("dragenter dragover", function (ev) {
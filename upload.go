@@ -8,22 +8,25 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
-
-	"cloud.google.com/go/datastore"
-	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
 )
 
 const uploadPath = "/upload"
 
+// maxItemLifetime bounds X-Expires-In to ten years, well within a time.Duration
+const maxItemLifetime = 10 * 365 * 24 * 60 * 60
+
 type uploadHandler struct {
-	projectID         string
-	googleLoginAppID  string
-	pubsubClient      *pubsub.Client
-	storageBucketName string
-	storageBucket     *storage.BucketHandle
-	datastoreClient   *datastore.Client
+	notificationBus  NotificationBus
+	blobStore        BlobStore
+	accessPolicy     *AccessPolicy
+	sessionStore     SessionStore
+	accessTokenStore AccessTokenStore
+	itemStore        ItemStore
+	usageStore       UsageStore
+	quotaDefaults    quotaLimits
+	downloadURLs     *DownloadURLs
 }
 
 func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -35,81 +38,115 @@ func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		uploadName := r.URL.Query().Get("name")
 
-		sessionToken := r.URL.Query().Get("token")
-
 		uploadType := r.Header.Get(http.CanonicalHeaderKey("Content-Type"))
 
 		var bodyReader io.Reader = r.Body
 
-		user, email, err := getUser(ctx, h.datastoreClient, sessionToken)
+		var expiry time.Time
+
+		// X-Expires-In is the lifetime of the item in seconds
+		if expiresInText := r.Header.Get("X-Expires-In"); expiresInText != "" {
+			expiresIn, err := strconv.ParseInt(expiresInText, 10, 64)
+
+			if err != nil || expiresIn <= 0 || expiresIn > maxItemLifetime {
+				http.Error(w, fmt.Sprint("X-Expires-In must be between 1 and ", maxItemLifetime, " seconds"), http.StatusBadRequest)
+				return
+			}
+
+			expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+		}
+
+		auth, err := authenticateRequest(ctx, h.accessPolicy, h.sessionStore, h.accessTokenStore, r, scopeUpload)
 
 		if err != nil {
-			log.Println("Invalid Token")
+			log.Println("Invalid session:", err)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
 
-		topic := createTopic(ctx, h.pubsubClient, user)
-
-		bodyBuffer := new(bytes.Buffer)
+		user := auth.User
 
-		if uploadType == clipboardMimeType {
-			bodyReader = io.TeeReader(bodyReader, bodyBuffer)
+		// The size is needed to check the quota before anything is stored
+		if r.ContentLength < 0 {
+			http.Error(w, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
+			return
 		}
 
-		objectName := fmt.Sprintf("%s/%016x", user, time.Now().UnixNano())
-
-		obj := h.storageBucket.Object(objectName)
-
-		objWriter := obj.NewWriter(ctx)
+		id, err := newItemID()
 
-		if _, err := io.Copy(objWriter, bodyReader); err != nil {
-			log.Println("Error streaming data:", err)
+		if err != nil {
+			log.Println("Error generating item ID:", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		if err := objWriter.Close(); err != nil {
-			log.Println("Error closing writer:", err)
+		if err := reserveUsage(ctx, h.usageStore, user, r.ContentLength, h.quotaDefaults); err == errorItemTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err == errorQuotaExceeded {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		} else if err != nil {
+			log.Println("Error reserving usage:", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		objectAttrsToUpdate := storage.ObjectAttrsToUpdate{
-			ACL: []storage.ACLRule{
-				{
-					Entity: storage.ACLEntity(fmt.Sprint("user-", email)),
-					Role:   storage.RoleReader,
-				},
-				{
-					Entity: storage.ACLEntity(fmt.Sprint("user-", h.projectID, "@appspot.gserviceaccount.com")),
-					Role:   storage.RoleReader,
-				},
-			},
-			Metadata: map[string]string{
-				metaDataName: uploadName,
-			},
+		releaseReservation := func() {
+			// The request context is done if the client went away, but the reservation must still be released
+			if err := releaseUsage(context.Background(), h.usageStore, user, r.ContentLength); err != nil {
+				log.Println("Error releasing usage:", err)
+			}
 		}
 
-		if uploadType != "" {
-			objectAttrsToUpdate.ContentType = uploadType
+		bodyBuffer := new(bytes.Buffer)
+
+		if uploadType == clipboardMimeType {
+			bodyReader = io.TeeReader(bodyReader, bodyBuffer)
 		}
 
-		if _, err := obj.Update(context.Background(), objectAttrsToUpdate); err != nil {
-			log.Println("Error updating file attributes:", err)
+		objectName := itemObjectName(user, id)
+
+		metadata := map[string]string{
+			metaDataName: uploadName,
+		}
+
+		// The expiry is kept with the blob as well as in the index, so that reconcile-items keeps it
+		if !expiry.IsZero() {
+			metadata[metaDataExpiry] = expiry.UTC().Format(time.RFC3339)
+		}
+
+		newAttrs, err := h.blobStore.Write(ctx, objectName, bodyReader, BlobWriteOptions{
+			ContentType: uploadType,
+			Metadata:    metadata,
+		})
+
+		if err != nil {
+			log.Println("Error storing data:", err)
+			releaseReservation()
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		newAttrs, err := obj.Attrs(context.Background())
+		body := bodyBuffer.String()
+
+		item := newClipItem(newAttrs, body)
+
+		if err := h.itemStore.Put(ctx, item); err != nil {
+			log.Println("Error indexing item:", err)
+
+			// Unindexed blobs would only be found again by reconcile-items
+			if err := h.blobStore.Delete(ctx, objectName); err != nil {
+				log.Println("Error removing unindexed item:", err)
+			}
+
+			releaseReservation()
 
-		if err != nil {
-			log.Println("Error getting object attributes")
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		notificationData, err := json.Marshal(createFileNotification(h.storageBucketName, newAttrs, bodyBuffer))
+		notificationData, err := json.Marshal(createFileNotification(item, body, h.downloadURLs.Sign(item, time.Now())))
 
 		if err != nil {
 			log.Println("Error marshalling notification:", err)
@@ -117,7 +154,11 @@ func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		topic.Publish(context.Background(), &pubsub.Message{Data: notificationData})
+		if err := h.notificationBus.Publish(ctx, user, notificationData); err != nil {
+			log.Println("Error publishing notification:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 
 		fmt.Fprintln(w, "Done")
 
@@ -127,13 +168,16 @@ func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 //UploadHandler handles the uploading of new files
-func UploadHandler(projectID string, googleLoginAppID string, pubsubClient *pubsub.Client, storageBucketName string, storageBucket *storage.BucketHandle, datastoreClient *datastore.Client) (string, http.Handler) {
+func UploadHandler(notificationBus NotificationBus, blobStore BlobStore, accessPolicy *AccessPolicy, sessionStore SessionStore, accessTokenStore AccessTokenStore, itemStore ItemStore, usageStore UsageStore, quotaDefaults quotaLimits, downloadURLs *DownloadURLs) (string, http.Handler) {
 	return uploadPath, &uploadHandler{
-		projectID:         projectID,
-		googleLoginAppID:  googleLoginAppID,
-		pubsubClient:      pubsubClient,
-		storageBucketName: storageBucketName,
-		storageBucket:     storageBucket,
-		datastoreClient:   datastoreClient,
+		notificationBus:  notificationBus,
+		blobStore:        blobStore,
+		accessPolicy:     accessPolicy,
+		sessionStore:     sessionStore,
+		accessTokenStore: accessTokenStore,
+		itemStore:        itemStore,
+		usageStore:       usageStore,
+		quotaDefaults:    quotaDefaults,
+		downloadURLs:     downloadURLs,
 	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreUsageStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreUsageStore(c *datastore.Client) *datastoreUsageStore {
+	return &datastoreUsageStore{
+		c: c,
+	}
+}
+
+func userUsageKey(user string) *datastore.Key {
+	return datastore.NameKey(userUsageKind, user, nil)
+}
+
+func (s *datastoreUsageStore) Get(ctx context.Context, user string) (*userUsage, error) {
+	var usage userUsage
+
+	if err := s.c.Get(ctx, userUsageKey(user), &usage); err == datastore.ErrNoSuchEntity {
+		return &userUsage{User: user}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+func (s *datastoreUsageStore) Update(ctx context.Context, user string, f func(usage *userUsage) error) (*userUsage, error) {
+	key := userUsageKey(user)
+
+	var usage userUsage
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		usage = userUsage{User: user}
+
+		if err := tx.Get(key, &usage); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if err := f(&usage); err != nil {
+			return err
+		}
+
+		usage.Updated = time.Now()
+
+		_, err := tx.Put(key, &usage)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+func (s *datastoreUsageStore) List(ctx context.Context) ([]*userUsage, error) {
+	list := []*userUsage{}
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(userUsageKind), &list); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (s *datastoreUsageStore) Reassign(ctx context.Context, from string, to string) error {
+	fromKey := userUsageKey(from)
+
+	_, err := s.c.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var usage userUsage
+
+		if err := tx.Get(fromKey, &usage); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		usage.User = to
+
+		if _, err := tx.Put(userUsageKey(to), &usage); err != nil {
+			return err
+		}
+
+		return tx.Delete(fromKey)
+	})
+
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryUsageStore keeps usage for the lifetime of the process
+type memoryUsageStore struct {
+	lock  sync.Mutex
+	usage map[string]userUsage
+}
+
+func newMemoryUsageStore() *memoryUsageStore {
+	return &memoryUsageStore{
+		usage: make(map[string]userUsage),
+	}
+}
+
+func (s *memoryUsageStore) Get(ctx context.Context, user string) (*userUsage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	usage, found := s.usage[user]
+
+	if !found {
+		return &userUsage{User: user}, nil
+	}
+
+	return &usage, nil
+}
+
+func (s *memoryUsageStore) Update(ctx context.Context, user string, f func(usage *userUsage) error) (*userUsage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	usage, found := s.usage[user]
+
+	if !found {
+		usage = userUsage{User: user}
+	}
+
+	if err := f(&usage); err != nil {
+		return nil, err
+	}
+
+	usage.Updated = time.Now()
+	s.usage[user] = usage
+
+	return &usage, nil
+}
+
+func (s *memoryUsageStore) List(ctx context.Context) ([]*userUsage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := []*userUsage{}
+
+	for _, usage := range s.usage {
+		usage := usage
+		list = append(list, &usage)
+	}
+
+	return list, nil
+}
+
+func (s *memoryUsageStore) Reassign(ctx context.Context, from string, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	usage, found := s.usage[from]
+
+	if !found {
+		return nil
+	}
+
+	delete(s.usage, from)
+
+	usage.User = to
+	s.usage[to] = usage
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteUsageStore struct {
+	db *sql.DB
+}
+
+func newSQLiteUsageStore(db *sql.DB) *sqliteUsageStore {
+	return &sqliteUsageStore{
+		db: db,
+	}
+}
+
+const sqliteUsageColumns = "user, bytes, items, max_bytes, max_items, max_item_size, updated"
+
+func scanSQLiteUsage(row sqliteScanner) (*userUsage, error) {
+	var usage userUsage
+
+	var updated int64
+
+	if err := row.Scan(&usage.User, &usage.Bytes, &usage.Items, &usage.MaxBytes, &usage.MaxItems, &usage.MaxItemSize, &updated); err != nil {
+		return nil, err
+	}
+
+	usage.Updated = fromSQLiteTime(updated)
+
+	return &usage, nil
+}
+
+func (s *sqliteUsageStore) Get(ctx context.Context, user string) (*userUsage, error) {
+	usage, err := scanSQLiteUsage(s.db.QueryRowContext(ctx, "SELECT "+sqliteUsageColumns+" FROM user_usage WHERE user = ?", user))
+
+	if err == sql.ErrNoRows {
+		return &userUsage{User: user}, nil
+	}
+
+	return usage, err
+}
+
+func (s *sqliteUsageStore) Update(ctx context.Context, user string, f func(usage *userUsage) error) (*userUsage, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	usage, err := scanSQLiteUsage(tx.QueryRowContext(ctx, "SELECT "+sqliteUsageColumns+" FROM user_usage WHERE user = ?", user))
+
+	if err == sql.ErrNoRows {
+		usage = &userUsage{User: user}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := f(usage); err != nil {
+		return nil, err
+	}
+
+	usage.Updated = time.Now()
+
+	if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO user_usage ("+sqliteUsageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		usage.User, usage.Bytes, usage.Items, usage.MaxBytes, usage.MaxItems, usage.MaxItemSize, sqliteTime(usage.Updated)); err != nil {
+		return nil, err
+	}
+
+	return usage, tx.Commit()
+}
+
+func (s *sqliteUsageStore) List(ctx context.Context) ([]*userUsage, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqliteUsageColumns+" FROM user_usage")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	list := []*userUsage{}
+
+	for rows.Next() {
+		usage, err := scanSQLiteUsage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, usage)
+	}
+
+	return list, rows.Err()
+}
+
+func (s *sqliteUsageStore) Reassign(ctx context.Context, from string, to string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE OR REPLACE user_usage SET user = ? WHERE user = ?", to, from)
+
+	return err
+}
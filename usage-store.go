@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const userUsageKind = "UserUsage"
+
+var errorItemTooLarge = errors.New("Item is larger than the quota allows")
+
+var errorQuotaExceeded = errors.New("Storage quota exceeded")
+
+// quotaLimits bound what a user may store, where 0 is no limit
+type quotaLimits struct {
+	MaxBytes    int64
+	MaxItems    int
+	MaxItemSize int64
+}
+
+// userUsage counts what a user stores, along with any quota overrides.
+// An override of 0 uses the default limit, and a negative override removes the limit.
+type userUsage struct {
+	User        string
+	Bytes       int64
+	Items       int
+	MaxBytes    int64
+	MaxItems    int
+	MaxItemSize int64
+	Updated     time.Time
+}
+
+func overrideLimit(override int64, limit int64) int64 {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	default:
+		return limit
+	}
+}
+
+// limits gives the user's quota, applying their overrides to the defaults
+func (u *userUsage) limits(defaults quotaLimits) quotaLimits {
+	return quotaLimits{
+		MaxBytes:    overrideLimit(u.MaxBytes, defaults.MaxBytes),
+		MaxItems:    int(overrideLimit(int64(u.MaxItems), int64(defaults.MaxItems))),
+		MaxItemSize: overrideLimit(u.MaxItemSize, defaults.MaxItemSize),
+	}
+}
+
+// reserve counts a new item of a size, returning errorItemTooLarge or errorQuotaExceeded if the quota does not allow it
+func (u *userUsage) reserve(size int64, defaults quotaLimits) error {
+	limits := u.limits(defaults)
+
+	if limits.MaxItemSize > 0 && size > limits.MaxItemSize {
+		return errorItemTooLarge
+	}
+
+	if limits.MaxBytes > 0 && u.Bytes+size > limits.MaxBytes || limits.MaxItems > 0 && u.Items+1 > limits.MaxItems {
+		return errorQuotaExceeded
+	}
+
+	u.Bytes += size
+	u.Items++
+
+	return nil
+}
+
+// release stops counting an item of a size, never counting below zero
+func (u *userUsage) release(size int64) {
+	u.Bytes -= size
+	u.Items--
+
+	if u.Bytes < 0 {
+		u.Bytes = 0
+	}
+
+	if u.Items < 0 {
+		u.Items = 0
+	}
+}
+
+// UsageStore persists users' storage usage and quota overrides, keyed by user
+type UsageStore interface {
+	// Get finds a user's usage, returning empty usage if nothing has been counted
+	Get(ctx context.Context, user string) (*userUsage, error)
+	// Update applies f to a user's usage atomically, starting from empty usage if nothing has been counted
+	Update(ctx context.Context, user string, f func(usage *userUsage) error) (*userUsage, error)
+	// List finds the usage of every user who has any
+	List(ctx context.Context) ([]*userUsage, error)
+	// Reassign moves a user's usage to another user ID
+	Reassign(ctx context.Context, from string, to string) error
+}
+
+// reserveUsage counts a new item against a user's quota before it is stored
+func reserveUsage(ctx context.Context, usageStore UsageStore, user string, size int64, defaults quotaLimits) error {
+	_, err := usageStore.Update(ctx, user, func(usage *userUsage) error {
+		return usage.reserve(size, defaults)
+	})
+
+	return err
+}
+
+// releaseUsage stops counting an item against a user's quota once it is deleted
+func releaseUsage(ctx context.Context, usageStore UsageStore, user string, size int64) error {
+	_, err := usageStore.Update(ctx, user, func(usage *userUsage) error {
+		usage.release(size)
+		return nil
+	})
+
+	return err
+}
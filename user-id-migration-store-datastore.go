@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+type datastoreUserIDMigrationStore struct {
+	c *datastore.Client
+}
+
+func newDatastoreUserIDMigrationStore(c *datastore.Client) *datastoreUserIDMigrationStore {
+	return &datastoreUserIDMigrationStore{
+		c: c,
+	}
+}
+
+func userIDMigrationKey(from string) *datastore.Key {
+	return datastore.NameKey(userIDMigrationKind, from, nil)
+}
+
+func (s *datastoreUserIDMigrationStore) Record(ctx context.Context, migration *userIDMigration) error {
+	_, err := s.c.Put(ctx, userIDMigrationKey(migration.From), migration)
+
+	return err
+}
+
+func (s *datastoreUserIDMigrationStore) List(ctx context.Context) ([]*userIDMigration, error) {
+	migrations := []*userIDMigration{}
+
+	if _, err := s.c.GetAll(ctx, datastore.NewQuery(userIDMigrationKind), &migrations); err != nil {
+		return nil, err
+	}
+
+	return migrations, nil
+}
+
+func (s *datastoreUserIDMigrationStore) Delete(ctx context.Context, from string) error {
+	return s.c.Delete(ctx, userIDMigrationKey(from))
+}
+
+func resolvedUserIDKey(id string) *datastore.Key {
+	return datastore.NameKey(resolvedUserIDKind, id, nil)
+}
+
+func (s *datastoreUserIDMigrationStore) MarkResolved(ctx context.Context, id string) error {
+	_, err := s.c.Put(ctx, resolvedUserIDKey(id), &resolvedUserID{
+		Created: time.Now(),
+	})
+
+	return err
+}
+
+func (s *datastoreUserIDMigrationStore) Resolved(ctx context.Context, id string) (bool, error) {
+	var resolved resolvedUserID
+
+	if err := s.c.Get(ctx, resolvedUserIDKey(id), &resolved); err == datastore.ErrNoSuchEntity {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryUserIDMigrationStore keeps user ID migrations for the lifetime of the process
+type memoryUserIDMigrationStore struct {
+	lock       sync.Mutex
+	migrations map[string]userIDMigration
+	resolved   map[string]bool
+}
+
+func newMemoryUserIDMigrationStore() *memoryUserIDMigrationStore {
+	return &memoryUserIDMigrationStore{
+		migrations: make(map[string]userIDMigration),
+		resolved:   make(map[string]bool),
+	}
+}
+
+func (s *memoryUserIDMigrationStore) Record(ctx context.Context, migration *userIDMigration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.migrations[migration.From] = *migration
+
+	return nil
+}
+
+func (s *memoryUserIDMigrationStore) List(ctx context.Context) ([]*userIDMigration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	migrations := []*userIDMigration{}
+
+	for _, migration := range s.migrations {
+		migration := migration
+		migrations = append(migrations, &migration)
+	}
+
+	return migrations, nil
+}
+
+func (s *memoryUserIDMigrationStore) Delete(ctx context.Context, from string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.migrations, from)
+
+	return nil
+}
+
+func (s *memoryUserIDMigrationStore) MarkResolved(ctx context.Context, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.resolved[id] = true
+
+	return nil
+}
+
+func (s *memoryUserIDMigrationStore) Resolved(ctx context.Context, id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.resolved[id], nil
+}
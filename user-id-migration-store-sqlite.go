@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteUserIDMigrationStore struct {
+	db *sql.DB
+}
+
+func newSQLiteUserIDMigrationStore(db *sql.DB) *sqliteUserIDMigrationStore {
+	return &sqliteUserIDMigrationStore{
+		db: db,
+	}
+}
+
+func (s *sqliteUserIDMigrationStore) Record(ctx context.Context, migration *userIDMigration) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO user_id_migrations (from_user, to_user, created) VALUES (?, ?, ?)",
+		migration.From, migration.To, sqliteTime(migration.Created))
+
+	return err
+}
+
+func (s *sqliteUserIDMigrationStore) List(ctx context.Context) ([]*userIDMigration, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT from_user, to_user, created FROM user_id_migrations")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	migrations := []*userIDMigration{}
+
+	for rows.Next() {
+		var migration userIDMigration
+
+		var created int64
+
+		if err := rows.Scan(&migration.From, &migration.To, &created); err != nil {
+			return nil, err
+		}
+
+		migration.Created = fromSQLiteTime(created)
+
+		migrations = append(migrations, &migration)
+	}
+
+	return migrations, rows.Err()
+}
+
+func (s *sqliteUserIDMigrationStore) Delete(ctx context.Context, from string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM user_id_migrations WHERE from_user = ?", from)
+
+	return err
+}
+
+func (s *sqliteUserIDMigrationStore) MarkResolved(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR IGNORE INTO resolved_user_ids (user, created) VALUES (?, ?)", id, sqliteTime(time.Now()))
+
+	return err
+}
+
+func (s *sqliteUserIDMigrationStore) Resolved(ctx context.Context, id string) (bool, error) {
+	var user string
+
+	if err := s.db.QueryRowContext(ctx, "SELECT user FROM resolved_user_ids WHERE user = ?", id).Scan(&user); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
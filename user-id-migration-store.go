@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const userIDMigrationKind = "UserIDMigration"
+
+const resolvedUserIDKind = "ResolvedUserID"
+
+// userIDMigration records that a user's data is still stored under an ID derived with an older secret
+type userIDMigration struct {
+	From    string
+	To      string
+	Created time.Time
+}
+
+// resolvedUserID records that no data was found under a user's older IDs, so they need not be looked for again
+type resolvedUserID struct {
+	Created time.Time
+}
+
+// UserIDMigrationStore persists the user IDs waiting to be migrated, keyed by the ID being migrated from,
+// and the current IDs known to have nothing left to migrate
+type UserIDMigrationStore interface {
+	// Record stores a migration, replacing any earlier migration from the same ID
+	Record(ctx context.Context, migration *userIDMigration) error
+	List(ctx context.Context) ([]*userIDMigration, error)
+	Delete(ctx context.Context, from string) error
+	// MarkResolved records that a current user ID has nothing left to migrate to it
+	MarkResolved(ctx context.Context, id string) error
+	// Resolved checks whether a current user ID was marked as having nothing left to migrate
+	Resolved(ctx context.Context, id string) (bool, error)
+}
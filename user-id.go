@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+// loadUserIDSecrets reads the comma separated secrets user IDs are derived with, newest first.
+// Older secrets are kept so that users can be found under their old IDs until they are migrated.
+func loadUserIDSecrets() ([][]byte, error) {
+	secretsText, secretsDeclared := os.LookupEnv("USER_ID_SECRETS")
+
+	if !secretsDeclared {
+		log.Println("Warning: user ID secrets not declared, defaulting to unkeyed SHA-256 user IDs, which anyone who knows a user's key can derive")
+		return nil, nil
+	}
+
+	var secrets [][]byte
+
+	for _, secret := range strings.Split(secretsText, ",") {
+		secret = strings.TrimSpace(secret)
+
+		if secret == "" {
+			return nil, errors.New("empty user ID secret")
+		}
+
+		secrets = append(secrets, []byte(secret))
+	}
+
+	return secrets, nil
+}
+
+// UserIDs derives the IDs users' sessions and clipboard items are stored under from their user keys
+type UserIDs struct {
+	secrets   [][]byte
+	blobStore BlobStore
+	stores    *Stores
+}
+
+func newUserIDs(secrets [][]byte, blobStore BlobStore, stores *Stores) *UserIDs {
+	return &UserIDs{
+		secrets:   secrets,
+		blobStore: blobStore,
+		stores:    stores,
+	}
+}
+
+func hmacUserKey(secret []byte, userKey string) string {
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(userKey))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// legacyUserID is the unkeyed ID users were given before user ID secrets were introduced
+func legacyUserID(userKey string) string {
+	hash := sha256.Sum256([]byte(userKey))
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Hash gives the ID a user's data is stored under with the newest secret
+func (u *UserIDs) Hash(userKey string) string {
+	if len(u.secrets) == 0 {
+		return legacyUserID(userKey)
+	}
+
+	return hmacUserKey(u.secrets[0], userKey)
+}
+
+// previous gives the IDs a user's data may still be stored under, newest first
+func (u *UserIDs) previous(userKey string) []string {
+	if len(u.secrets) == 0 {
+		return nil
+	}
+
+	var ids []string
+
+	for _, secret := range u.secrets[1:] {
+		ids = append(ids, hmacUserKey(secret, userKey))
+	}
+
+	return append(ids, legacyUserID(userKey))
+}
+
+// hasData checks whether any clipboard items, access tokens or passkeys are stored under a user ID
+func (u *UserIDs) hasData(ctx context.Context, id string) (bool, error) {
+	if _, err := u.blobStore.List(ctx, id+"/").Next(); err == nil {
+		return true, nil
+	} else if err != iterator.Done {
+		return false, err
+	}
+
+	tokens, err := u.stores.AccessTokens.List(ctx, id)
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(tokens) > 0 {
+		return true, nil
+	}
+
+	keys, err := u.stores.Passkeys.List(ctx, id)
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(keys) > 0, nil
+}
+
+// record notes that a user's data must be migrated from an old ID to their current one
+func (u *UserIDs) record(ctx context.Context, from string, to string) error {
+	log.Println("User", from, "is waiting to be migrated to", to)
+
+	return u.stores.UserIDMigrations.Record(ctx, &userIDMigration{
+		From:    from,
+		To:      to,
+		Created: time.Now(),
+	})
+}
+
+// Resolve gives the ID a user's data is stored under.
+// Until migrate-user-ids has run, users with data under an ID from an older secret keep using it.
+// Once none is found the current ID is marked as resolved, so older IDs are only looked for again after the secrets change.
+func (u *UserIDs) Resolve(ctx context.Context, userKey string) (string, error) {
+	current := u.Hash(userKey)
+
+	previous := u.previous(userKey)
+
+	if len(previous) == 0 {
+		return current, nil
+	}
+
+	resolved, err := u.stores.UserIDMigrations.Resolved(ctx, current)
+
+	if err != nil {
+		return "", err
+	}
+
+	if resolved {
+		return current, nil
+	}
+
+	for _, id := range previous {
+		found, err := u.hasData(ctx, id)
+
+		if err != nil {
+			return "", err
+		}
+
+		if found {
+			return id, u.record(ctx, id, current)
+		}
+	}
+
+	// Looking again next time is only slower, so the user need not be refused
+	if err := u.stores.UserIDMigrations.MarkResolved(ctx, current); err != nil {
+		log.Println("Error marking user ID", current, "as resolved:", err)
+	}
+
+	return current, nil
+}
+
+// Track records a migration for a user whose ID is stored, if it is not the current ID for their user key
+func (u *UserIDs) Track(ctx context.Context, userKey string, id string) error {
+	if current := u.Hash(userKey); id != current {
+		return u.record(ctx, id, current)
+	}
+
+	return nil
+}